@@ -0,0 +1,287 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthBearer checks bearer tokens: JWT signed by configured public key (RS256, RS384, RS512,
+// ES256, ES384, ES512, EdDSA), or opaque tokens from file in format username:token.
+type AuthBearer struct {
+	publicKeyFile string
+	tokensFile    string
+
+	usernameClaim string
+	issuer        string
+	audience      string
+
+	publicKey   crypto.PublicKey
+	tokens      map[string]string
+	tokensMutex *sync.RWMutex
+}
+
+func (a *AuthBearer) GetName() string {
+	return "bearer"
+}
+
+func (a *AuthBearer) Init() error {
+	if len(a.publicKeyFile) > 0 {
+		data, err := ioutil.ReadFile(a.publicKeyFile)
+		if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("bearer public key %s is not in pem format", a.publicKeyFile)
+		}
+
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			a.publicKey = cert.PublicKey
+		} else if a.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return err
+		}
+	}
+
+	return a.Reload()
+}
+
+// Reload reads file with tokens again, public key is loaded only by Init.
+func (a *AuthBearer) Reload() error {
+	tokens := map[string]string{}
+	if len(a.tokensFile) > 0 {
+		data, err := ioutil.ReadFile(a.tokensFile)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range strings.Split(string(data), "\n") {
+			s := strings.SplitN(strings.TrimSpace(i), ":", 2)
+			if len(s) == 2 && len(s[0]) > 0 && len(s[1]) > 0 {
+				tokens[s[1]] = s[0]
+			}
+		}
+	}
+
+	a.tokensMutex.Lock()
+	a.tokens = tokens
+	a.tokensMutex.Unlock()
+
+	return nil
+}
+
+func (a *AuthBearer) Close() error {
+	return nil
+}
+
+func (a *AuthBearer) Scheme() string {
+	return "Bearer"
+}
+
+func (a *AuthBearer) Challenge(stale bool) string {
+	return "Bearer realm=\"virgild\""
+}
+
+func (a *AuthBearer) CheckHTTP(method, uri, credentials string) (string, bool, error) {
+	return a.CheckToken(strings.TrimSpace(credentials))
+}
+
+func (a *AuthBearer) CheckToken(token string) (string, bool, error) {
+	a.tokensMutex.RLock()
+	for t, username := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			a.tokensMutex.RUnlock()
+			return username, true, nil
+		}
+	}
+	a.tokensMutex.RUnlock()
+
+	if a.publicKey == nil || strings.Count(token, ".") != 2 {
+		return "", false, nil
+	}
+
+	return a.checkJWT(token)
+}
+
+func (a *AuthBearer) verifySignature(alg string, signed, signature []byte) error {
+	var hasher hash.Hash
+	var hashType crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hasher, hashType = sha256.New(), crypto.SHA256
+	case "384":
+		hasher, hashType = sha512.New384(), crypto.SHA384
+	case "512":
+		hasher, hashType = sha512.New(), crypto.SHA512
+	}
+
+	// Algorithm must match type of the key, so "none" or HMAC with public key as secret will never work.
+	switch key := a.publicKey.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || hasher == nil {
+			return fmt.Errorf("jwt algorithm %s doesn't match rsa key", alg)
+		}
+		hasher.Write(signed)
+		return rsa.VerifyPKCS1v15(key, hashType, hasher.Sum(nil), signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || hasher == nil {
+			return fmt.Errorf("jwt algorithm %s doesn't match ecdsa key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != size*2 {
+			return fmt.Errorf("jwt signature has wrong length")
+		}
+		hasher.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, hasher.Sum(nil), r, s) {
+			return fmt.Errorf("jwt signature is wrong")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("jwt algorithm %s doesn't match ed25519 key", alg)
+		}
+		if !ed25519.Verify(key, signed, signature) {
+			return fmt.Errorf("jwt signature is wrong")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("bearer public key type not supported")
+}
+
+func (a *AuthBearer) checkJWT(token string) (string, bool, error) {
+	parts := strings.Split(token, ".")
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false, err
+	}
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return "", false, err
+	}
+	if len(header.Alg) < 5 {
+		return "", false, fmt.Errorf("jwt algorithm \"%s\" not supported", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", false, err
+	}
+	if err = a.verifySignature(header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return "", false, err
+	}
+
+	if data, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return "", false, err
+	}
+	claims := map[string]interface{}{}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return "", false, err
+	}
+
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return "", false, fmt.Errorf("jwt token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return "", false, fmt.Errorf("jwt token not valid yet")
+	}
+	if len(a.issuer) > 0 && claims["iss"] != a.issuer {
+		return "", false, fmt.Errorf("jwt token issuer is wrong")
+	}
+	if len(a.audience) > 0 && !jwtHasAudience(claims["aud"], a.audience) {
+		return "", false, fmt.Errorf("jwt token audience is wrong")
+	}
+
+	username, ok := claims[a.usernameClaim].(string)
+	if !ok || len(username) == 0 {
+		return "", false, fmt.Errorf("jwt token doesn't have \"%s\" claim", a.usernameClaim)
+	}
+
+	return username, true, nil
+}
+
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch t := aud.(type) {
+	case string:
+		return t == audience
+	case []interface{}:
+		for _, i := range t {
+			if i == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func NewAuthBearer(publicKeyFile, tokensFile, usernameClaim, issuer, audience string) (*AuthBearer, error) {
+	if len(publicKeyFile) == 0 && len(tokensFile) == 0 {
+		return nil, fmt.Errorf("bearer auth needs public key or tokens file")
+	}
+	if len(usernameClaim) == 0 {
+		usernameClaim = "sub"
+	}
+
+	auth := &AuthBearer{
+		publicKeyFile: publicKeyFile,
+		tokensFile:    tokensFile,
+
+		usernameClaim: usernameClaim,
+		issuer:        issuer,
+		audience:      audience,
+
+		tokens:      map[string]string{},
+		tokensMutex: &sync.RWMutex{},
+	}
+
+	return auth, nil
+}
@@ -0,0 +1,308 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrStaleNonce = errors.New("digest nonce is stale")
+
+type digestNonce struct {
+	created int64
+	nc      uint64
+}
+
+// AuthDigest implements HTTP Digest authentication (RFC 7616) with SHA-256. Passwords can't be checked
+// against hashes from another auth methods, so it uses own file in htdigest format: username:realm:hash,
+// where hash is hex of sha256("username:realm:password").
+type AuthDigest struct {
+	file         string
+	realm        string
+	nonceTimeout int64
+
+	users       map[string]string
+	usersMutex  *sync.RWMutex
+	nonces      map[string]*digestNonce
+	noncesMutex *sync.Mutex
+}
+
+func digestHash(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// parseDigestParams parses comma separated key=value list, where value may be quoted.
+func parseDigestParams(data string) map[string]string {
+	params := map[string]string{}
+	for len(data) > 0 {
+		data = strings.TrimLeft(data, " \t,")
+		eq := strings.IndexByte(data, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(data[:eq]))
+		data = strings.TrimLeft(data[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(data, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				b.WriteByte(data[i])
+			}
+			value = b.String()
+			if i < len(data) {
+				i++
+			}
+			data = data[i:]
+		} else {
+			end := strings.IndexByte(data, ',')
+			if end < 0 {
+				end = len(data)
+			}
+			value = strings.TrimSpace(data[:end])
+			data = data[end:]
+		}
+
+		params[key] = value
+	}
+
+	return params
+}
+
+// cleanNonces must be called with noncesMutex locked.
+func (a *AuthDigest) cleanNonces(now int64) {
+	for key, n := range a.nonces {
+		if now-n.created > a.nonceTimeout {
+			delete(a.nonces, key)
+		}
+	}
+}
+
+func (a *AuthDigest) newNonce() string {
+	t := make([]byte, 18)
+	rand.Read(t)
+	nonce := base64.RawURLEncoding.EncodeToString(t)
+
+	now := time.Now().Unix()
+
+	a.noncesMutex.Lock()
+	a.cleanNonces(now)
+	a.nonces[nonce] = &digestNonce{created: now}
+	a.noncesMutex.Unlock()
+
+	return nonce
+}
+
+// checkNonce validates nonce and nonce count, so the same response can't be replayed.
+func (a *AuthDigest) checkNonce(nonce string, nc uint64) error {
+	now := time.Now().Unix()
+
+	a.noncesMutex.Lock()
+	defer a.noncesMutex.Unlock()
+
+	a.cleanNonces(now)
+
+	n, ok := a.nonces[nonce]
+	if !ok {
+		// Not issued by us or expired, anyway client must retry with new one.
+		return ErrStaleNonce
+	}
+	if nc <= n.nc {
+		return fmt.Errorf("digest nonce count %d already used", nc)
+	}
+	n.nc = nc
+
+	return nil
+}
+
+// digestURIMatches compares uri from credentials with request target. Some clients send only path
+// of the absolute uri, that was requested from proxy.
+func digestURIMatches(digestURI, uri string) bool {
+	if digestURI == uri {
+		return true
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return false
+	}
+
+	return digestURI == u.RequestURI()
+}
+
+func (a *AuthDigest) GetName() string {
+	return "digest"
+}
+
+func (a *AuthDigest) Init() error {
+	data, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+
+	users := map[string]string{}
+	for _, i := range strings.Split(string(data), "\n") {
+		s := strings.SplitN(strings.TrimSpace(i), ":", 3)
+		if len(s) == 3 && len(s[0]) > 0 && s[1] == a.realm && len(s[2]) > 0 {
+			users[s[0]] = strings.ToLower(s[2])
+		}
+	}
+
+	a.usersMutex.Lock()
+	a.users = users
+	a.usersMutex.Unlock()
+
+	return nil
+}
+
+// Reload reads file with users again.
+func (a *AuthDigest) Reload() error {
+	return a.Init()
+}
+
+func (a *AuthDigest) Users() ([]string, error) {
+	a.usersMutex.RLock()
+	defer a.usersMutex.RUnlock()
+
+	users := make([]string, 0, len(a.users))
+	for username := range a.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+
+	return users, nil
+}
+
+func (a *AuthDigest) Close() error {
+	return nil
+}
+
+func (a *AuthDigest) Scheme() string {
+	return "Digest"
+}
+
+func (a *AuthDigest) Challenge(stale bool) string {
+	challenge := fmt.Sprintf("Digest realm=\"%s\", qop=\"auth\", algorithm=SHA-256, nonce=\"%s\", charset=UTF-8, userhash=true", a.realm, a.newNonce())
+	if stale {
+		challenge += ", stale=true"
+	}
+
+	return challenge
+}
+
+func (a *AuthDigest) CheckHTTP(method, uri, credentials string) (string, bool, error) {
+	params := parseDigestParams(credentials)
+
+	if algorithm := params["algorithm"]; len(algorithm) > 0 && !strings.EqualFold(algorithm, "SHA-256") {
+		return "", false, fmt.Errorf("digest algorithm %s not supported", algorithm)
+	}
+	if params["realm"] != a.realm {
+		return "", false, fmt.Errorf("digest realm \"%s\" is wrong", params["realm"])
+	}
+	if params["qop"] != "auth" {
+		return "", false, fmt.Errorf("digest qop \"%s\" not supported", params["qop"])
+	}
+	if len(uri) > 0 && !digestURIMatches(params["uri"], uri) {
+		return "", false, fmt.Errorf("digest uri \"%s\" doesn't match request", params["uri"])
+	}
+
+	username, ha1, ok := a.findUser(params["username"], params["userhash"] == "true")
+	if !ok {
+		return "", false, nil
+	}
+
+	ha2 := digestHash(method + ":" + params["uri"])
+	expected := digestHash(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", false, nil
+	}
+
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return "", false, fmt.Errorf("digest nonce count is wrong")
+	}
+	if err = a.checkNonce(params["nonce"], nc); err != nil {
+		return "", false, err
+	}
+
+	return username, true, nil
+}
+
+// findUser returns name and ha1 of user, username may be hash of name and realm (RFC 7616 userhash).
+func (a *AuthDigest) findUser(username string, userhash bool) (string, string, bool) {
+	a.usersMutex.RLock()
+	defer a.usersMutex.RUnlock()
+
+	if userhash {
+		for name, ha1 := range a.users {
+			if digestHash(name+":"+a.realm) == strings.ToLower(username) {
+				return name, ha1, true
+			}
+		}
+
+		return "", "", false
+	}
+
+	ha1, ok := a.users[username]
+	return username, ha1, ok
+}
+
+func NewAuthDigest(file, realm string, nonceTimeout int64) (*AuthDigest, error) {
+	if len(realm) == 0 {
+		realm = "virgild"
+	}
+	if nonceTimeout <= 0 {
+		nonceTimeout = 300
+	}
+
+	auth := &AuthDigest{
+		file:         file,
+		realm:        realm,
+		nonceTimeout: nonceTimeout,
+
+		users:       map[string]string{},
+		usersMutex:  &sync.RWMutex{},
+		nonces:      map[string]*digestNonce{},
+		noncesMutex: &sync.Mutex{},
+	}
+
+	return auth, nil
+}
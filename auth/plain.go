@@ -24,13 +24,18 @@ package auth
 
 import (
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type AuthPlain struct {
 	file   string
 	hasher *authHasher
 	users  map[string]string
+
+	attributes map[string]map[string]string
+	usersMutex *sync.RWMutex
 }
 
 func (a *AuthPlain) GetName() string {
@@ -43,23 +48,59 @@ func (a *AuthPlain) Init() error {
 		return err
 	}
 
-	a.users = map[string]string{}
+	users := map[string]string{}
+	attributes := map[string]map[string]string{}
 	for _, i := range strings.Split(string(data), "\n") {
-		s := strings.SplitN(i, ":", 2)
-		if len(s) == 2 && len(s[0]) > 0 && len(s[1]) > 0 {
-			a.users[s[0]] = s[1]
+		// Optional columns after password are attributes: "username:hash:groups=a,b:bandwidth=1024".
+		s := strings.Split(strings.TrimRight(i, "\r"), ":")
+		if len(s) >= 2 && len(s[0]) > 0 && len(s[1]) > 0 {
+			users[s[0]] = s[1]
+		}
+		if len(s) > 2 {
+			userAttributes := map[string]string{}
+			for _, column := range s[2:] {
+				if t := strings.SplitN(column, "=", 2); len(t) == 2 {
+					userAttributes[strings.TrimSpace(t[0])] = t[1]
+				}
+			}
+			attributes[s[0]] = userAttributes
 		}
 	}
 
+	a.usersMutex.Lock()
+	a.users = users
+	a.attributes = attributes
+	a.usersMutex.Unlock()
+
 	return nil
 }
 
+// Reload reads file with users again.
+func (a *AuthPlain) Reload() error {
+	return a.Init()
+}
+
+func (a *AuthPlain) Users() ([]string, error) {
+	a.usersMutex.RLock()
+	defer a.usersMutex.RUnlock()
+
+	users := make([]string, 0, len(a.users))
+	for username := range a.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+
+	return users, nil
+}
+
 func (a *AuthPlain) Close() error {
 	return nil
 }
 
 func (a *AuthPlain) Check(username, password string) (bool, error) {
+	a.usersMutex.RLock()
 	hashedPassword, ok := a.users[username]
+	a.usersMutex.RUnlock()
 	if !ok {
 		return false, nil
 	}
@@ -71,13 +112,20 @@ func (a *AuthPlain) Check(username, password string) (bool, error) {
 	return false, nil
 }
 
+func (a *AuthPlain) Attributes(username string) (map[string]string, error) {
+	a.usersMutex.RLock()
+	defer a.usersMutex.RUnlock()
+
+	return a.attributes[username], nil
+}
+
 func NewAuthPlain(file, hashMethod string) (*AuthPlain, error) {
 	hasher, err := newHasher(hashMethod)
 	if err != nil {
 		return nil, err
 	}
 
-	auth := &AuthPlain{file: file, hasher: hasher, users: map[string]string{}}
+	auth := &AuthPlain{file: file, hasher: hasher, users: map[string]string{}, usersMutex: &sync.RWMutex{}}
 
 	return auth, nil
 }
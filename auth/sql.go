@@ -24,6 +24,7 @@ package auth
 
 import (
 	"database/sql"
+	"strings"
 	"sync"
 	"time"
 )
@@ -33,6 +34,11 @@ type cachedUser struct {
 	stored         int64
 }
 
+type cachedAttributes struct {
+	attributes map[string]string
+	stored     int64
+}
+
 type AuthSQL struct {
 	dbType string
 	db     *sql.DB
@@ -43,6 +49,9 @@ type AuthSQL struct {
 	usersCacheTimeout int64
 
 	querySelectUser string
+
+	attributes                map[string]*cachedAttributes
+	querySelectUserAttributes string
 }
 
 func (a *AuthSQL) GetUserFromCache(username string) (string, bool) {
@@ -83,6 +92,40 @@ func (a *AuthSQL) PutUserToCache(username, hashedPassword string) {
 	}
 }
 
+func (a *AuthSQL) getAttributesFromCache(username string) (map[string]string, bool) {
+	if a.usersCacheTimeout < 0 {
+		return nil, false
+	}
+
+	a.usersMutex.RLock()
+	cached, ok := a.attributes[username]
+	a.usersMutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	if a.usersCacheTimeout > 0 && time.Now().Unix()-cached.stored > a.usersCacheTimeout {
+		a.usersMutex.Lock()
+		delete(a.attributes, username)
+		a.usersMutex.Unlock()
+
+		return nil, false
+	}
+
+	return cached.attributes, true
+}
+
+func (a *AuthSQL) putAttributesToCache(username string, attributes map[string]string) {
+	if a.usersCacheTimeout >= 0 {
+		a.usersMutex.Lock()
+		a.attributes[username] = &cachedAttributes{
+			attributes: attributes,
+			stored:     time.Now().Unix(),
+		}
+		a.usersMutex.Unlock()
+	}
+}
+
 func (a *AuthSQL) GetName() string {
 	return a.dbType
 }
@@ -96,6 +139,16 @@ func (a *AuthSQL) Init() error {
 	return nil
 }
 
+// Reload drops cached users, so they are read from database again.
+func (a *AuthSQL) Reload() error {
+	a.usersMutex.Lock()
+	a.users = map[string]*cachedUser{}
+	a.attributes = map[string]*cachedAttributes{}
+	a.usersMutex.Unlock()
+
+	return nil
+}
+
 func (a *AuthSQL) Close() error {
 	if a.db != nil {
 		a.db.Close()
@@ -139,7 +192,61 @@ func (a *AuthSQL) Check(username, password string) (bool, error) {
 	return false, nil
 }
 
-func NewAuthSQL(dbType, dbConnection string, dbMaxConnections int, hashMethod string, cacheTimeout int64, querySelectUser string) (*AuthSQL, error) {
+// Attributes loads attributes of user with configured query, names of columns are names of attributes.
+func (a *AuthSQL) Attributes(username string) (map[string]string, error) {
+	if len(a.querySelectUserAttributes) == 0 {
+		return nil, nil
+	}
+
+	if attributes, ok := a.getAttributesFromCache(username); ok {
+		return attributes, nil
+	}
+
+	stmt, err := a.db.Prepare(a.querySelectUserAttributes)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes map[string]string
+	if rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		attributes = map[string]string{}
+		for i, column := range columns {
+			if values[i].Valid {
+				attributes[strings.ToLower(column)] = values[i].String
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	a.putAttributesToCache(username, attributes)
+
+	return attributes, nil
+}
+
+func NewAuthSQL(dbType, dbConnection string, dbMaxConnections int, hashMethod string, cacheTimeout int64, querySelectUser, querySelectUserAttributes string) (*AuthSQL, error) {
 	hasher, err := newHasher(hashMethod)
 	if err != nil {
 		return nil, err
@@ -161,6 +268,9 @@ func NewAuthSQL(dbType, dbConnection string, dbMaxConnections int, hashMethod st
 		usersCacheTimeout: cacheTimeout,
 
 		querySelectUser: querySelectUser,
+
+		attributes:                map[string]*cachedAttributes{},
+		querySelectUserAttributes: querySelectUserAttributes,
 	}
 
 	return auth, nil
@@ -67,6 +67,6 @@ func newHasher(hashMethod string) (*authHasher, error) {
 	} else if hashMethod == "sha512" {
 		return &authHasher{hashSHA512}, nil
 	} else {
-		return nil, fmt.Errorf("auth don't support hash method:", hashMethod)
+		return nil, fmt.Errorf("auth don't support hash method: %s", hashMethod)
 	}
 }
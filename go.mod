@@ -3,8 +3,12 @@ module virgild
 go 1.16
 
 require (
+	github.com/klauspost/cpuid/v2 v2.0.11 // indirect
 	github.com/sirupsen/logrus v1.9.0
-	golang.org/x/sys v0.2.0 // indirect
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
 	gopkg.in/gcfg.v1 v1.2.3
 	gopkg.in/warnings.v0 v0.1.2 // indirect
+	lukechampine.com/blake3 v1.1.7
 )
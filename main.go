@@ -36,12 +36,14 @@ import (
 )
 
 var (
-	config *models.Config
+	config     *models.Config
+	configPath string
 )
 
 func init() {
 	configPtr := flag.String("c", "virgild.conf", "Config file to use")
 	flag.Parse()
+	configPath = *configPtr
 
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
 
@@ -82,16 +84,8 @@ func main() {
 			log.Fatalln("(tcp bind) you must setup your external ip (or hostname) for tcp binding.")
 		}
 
-		config.Server.TCPBindAddrIP = net.ParseIP(config.Server.TCPBindAddr)
-		if config.Server.TCPBindAddrIP != nil {
-			// Just fix to make sure, that tcpBindAddrIP have 4 bytes in net.IP slice.
-			t := config.Server.TCPBindAddrIP.To4()
-			if t != nil {
-				config.Server.TCPBindAddrIP = t
-			}
-		} else {
-			config.Server.TCPBindAddrIsHostname = true
-			config.Server.TCPBindAddrHostname = config.Server.TCPBindAddr
+		for _, addr := range config.Server.TCPBindAddr {
+			config.Server.TCPBindAddrs = append(config.Server.TCPBindAddrs, models.NewBindAddr(addr))
 		}
 	}
 	if config.Server.AllowUDPAssociation {
@@ -101,6 +95,11 @@ func main() {
 		if len(config.Server.UDPAssociationAddr) == 0 {
 			log.Fatalln("(udp bind) you must setup your external ip (or hostname) for udp association.")
 		}
+		switch config.Server.UDPAssociationFiltering {
+		case "", "endpoint-independent", "address-dependent", "address-port-dependent":
+		default:
+			log.Fatalln("(udp bind) unknown udp association filtering:", config.Server.UDPAssociationFiltering)
+		}
 
 		config.Server.UDPAssociationAddrIP = net.ParseIP(config.Server.UDPAssociationAddr)
 		if config.Server.UDPAssociationAddrIP != nil {
@@ -115,12 +114,116 @@ func main() {
 		}
 	}
 
+	if len(config.Server.TransparentBind) > 0 {
+		switch config.Server.TransparentMode {
+		case "":
+			config.Server.TransparentMode = "redirect"
+		case "redirect", "tproxy":
+		default:
+			log.Fatalln("(transparent proxy) unknown mode:", config.Server.TransparentMode)
+		}
+	}
+
+	switch config.Server.Socks4Auth {
+	case "", "password", "token":
+	default:
+		log.Fatalln("(socks4) unknown authentication:", config.Server.Socks4Auth)
+	}
+
+	config.Server.Socks4IdentSubnets = &models.SubnetChecker{}
+	if err := config.Server.Socks4IdentSubnets.Load(config.Server.Socks4IdentTrusted); err != nil {
+		log.Fatalln("(socks4 ident trusted subnets)", err)
+	}
+	if config.Server.Socks4Ident && config.Server.Socks4IdentSubnets.Empty() {
+		log.Fatalln("(socks4) ident is used only for clients from trusted subnets, set socks4IdentTrusted")
+	}
+
+	if len(config.Mux.Bind) > 0 && (len(config.Mux.PublicKey) == 0 || len(config.Mux.PrivateKey) == 0) &&
+		!config.Mux.Insecure {
+		log.Fatalln("(mux) relay credentials can't be accepted without tls, setup keys or set insecure = true")
+	}
+
+	if len(config.Relay.Address) > 0 {
+		// Relay client sends only tcp connections to central server.
+		if config.Server.AllowTCPBind || config.Server.AllowUDPAssociation || config.Server.AllowUDPOverTCP ||
+			config.Shadowsocks.UDP || config.Server.TransparentMode == "tproxy" {
+			log.Fatalln("(relay) tcp bind and udp can't be used in relay client mode")
+		}
+	}
+
+	if len(config.SSH.Bind) > 0 && len(config.SSH.HostKey) == 0 {
+		log.Fatalln("(ssh) you must setup at least 1 host key (ssh-keygen -t ed25519 -f ssh_host_key -N \"\").")
+	}
+
+	if config.Quota.ResetDay == 0 {
+		config.Quota.ResetDay = 1
+	}
+	if config.Quota.ResetDay < 1 || config.Quota.ResetDay > 28 {
+		log.Fatalln("(quota) reset day must be from 1 to 28")
+	}
+	if config.Quota.SaveInterval <= 0 {
+		config.Quota.SaveInterval = 60
+	}
+
+	for name, upstream := range config.Upstream {
+		switch upstream.Type {
+		case "socks5", "http":
+		default:
+			log.Fatalf("(upstream %s) unknown type: %s", name, upstream.Type)
+		}
+		if len(upstream.Address) == 0 {
+			log.Fatalf("(upstream %s) you must setup address of upstream proxy", name)
+		}
+	}
+	if len(config.UsernameParams.Key) > 0 && len(config.UsernameParams.Separator) == 0 {
+		config.UsernameParams.Separator = "-"
+	}
+	for name, pool := range config.Pool {
+		for _, address := range pool.Address {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				log.Fatalf("(pool %s) wrong address: %s", name, address)
+			}
+			pool.IPs = append(pool.IPs, ip)
+		}
+		if len(pool.IPs) == 0 {
+			log.Fatalf("(pool %s) you must setup at least 1 address", name)
+		}
+	}
+
+	if err := config.LoadPolicy(); err != nil {
+		log.Fatalln("(config)", err)
+	}
+
+	if len(config.Admin.Bind) > 0 && len(config.Admin.Token) == 0 {
+		log.Fatalln("(admin) you must setup token for admin api")
+	}
+	config.Admin.ConfigPath = configPath
+
+	for name, forward := range config.Forward {
+		if len(forward.Bind) == 0 || len(forward.Target) == 0 {
+			log.Fatalf("(forward %s) you must setup bind and target addresses", name)
+		}
+		for _, upstreamName := range forward.Upstream {
+			upstream, ok := config.Upstream[upstreamName]
+			if !ok {
+				log.Fatalf("(forward %s) unknown upstream: %s", name, upstreamName)
+			}
+			forward.Upstreams = append(forward.Upstreams, upstream)
+		}
+	}
+
 	authMethods, err := config.GetAuthMethods()
 	if err != nil {
 		log.Fatalln("(auth)", err)
 	}
 
-	if len(authMethods) == 0 && !config.Server.AllowAnonymous {
+	httpAuthMethods, err := config.GetHTTPAuthMethods()
+	if err != nil {
+		log.Fatalln("(http auth)", err)
+	}
+
+	if len(authMethods) == 0 && len(httpAuthMethods) == 0 && !config.Server.AllowAnonymous {
 		log.Fatalln("(auth) current configuration will not work, because anonymous login disabled and no other auth methods configured.")
 	}
 
@@ -139,15 +242,45 @@ func main() {
 		log.Fatalln("(allowed remote subnets)", err)
 	}
 
+	privateRemoteSubnets := &models.SubnetChecker{}
+	if config.Subnets.DenyPrivateRemote {
+		if err = privateRemoteSubnets.Load(models.PrivateSubnets); err != nil {
+			log.Fatalln("(private remote subnets)", err)
+		}
+	}
+
+	allowedPrivateRemoteSubnets := &models.SubnetChecker{}
+	if err = allowedPrivateRemoteSubnets.Load(config.Subnets.AllowPrivateRemote); err != nil {
+		log.Fatalln("(allowed private remote subnets)", err)
+	}
+
+	switch config.ProxyProtocol.Send {
+	case "":
+		config.ProxyProtocol.Send = "v1"
+	case "v1", "v2":
+	default:
+		log.Fatalln("(proxy protocol) unknown version:", config.ProxyProtocol.Send)
+	}
+
+	proxyProtocolSubnets := &models.SubnetChecker{}
+	if err = proxyProtocolSubnets.Load(config.ProxyProtocol.Trusted); err != nil {
+		log.Fatalln("(proxy protocol trusted subnets)", err)
+	}
+
+	proxyProtocolSendSubnets := &models.SubnetChecker{}
+	if err = proxyProtocolSendSubnets.Load(config.ProxyProtocol.SendTo); err != nil {
+		log.Fatalln("(proxy protocol send subnets)", err)
+	}
+
 	proxyServers := []*proxy.Server{}
 	if len(config.Server.Bind) > 0 {
 		var err error
 		var server *proxy.Server
 		if len(config.Server.PrivateKey) > 0 && len(config.Server.PublicKey) > 0 {
 			/// If you want to generate self signed cert for server, use something like this: openssl req -x509 -newkey rsa:4096 -keyout private.key -out public.key -nodes -days 365
-			server, err = proxy.NewServer(config, true, authMethods, allowedSubnets, blockedSubnets, allowedRemoteSubnets)
+			server, err = proxy.NewServer(config, true, authMethods, httpAuthMethods, allowedSubnets, blockedSubnets, allowedRemoteSubnets, privateRemoteSubnets, allowedPrivateRemoteSubnets, proxyProtocolSubnets, proxyProtocolSendSubnets)
 		} else {
-			server, err = proxy.NewServer(config, false, authMethods, allowedSubnets, blockedSubnets, allowedRemoteSubnets)
+			server, err = proxy.NewServer(config, false, authMethods, httpAuthMethods, allowedSubnets, blockedSubnets, allowedRemoteSubnets, privateRemoteSubnets, allowedPrivateRemoteSubnets, proxyProtocolSubnets, proxyProtocolSendSubnets)
 		}
 		if err != nil {
 			log.Fatalln("(proxy server)", err)
@@ -194,6 +327,9 @@ func main() {
 	for _, a := range authMethods {
 		a.Close()
 	}
+	for _, a := range httpAuthMethods {
+		a.Close()
+	}
 
 	log.Warn("Exiting... Have a nice day.")
 
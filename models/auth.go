@@ -29,3 +29,30 @@ type AuthMethod interface {
 	Close() error
 	Check(username, password string) (bool, error)
 }
+
+// AttributesMethod is implemented by auth methods, that store attributes of users (groups, limits and so on).
+// Nil attributes are returned for users without them.
+type AttributesMethod interface {
+	Attributes(username string) (map[string]string, error)
+}
+
+// ReloadMethod is implemented by auth methods, that can read their users again without restart.
+type ReloadMethod interface {
+	Reload() error
+}
+
+// UsersMethod is implemented by auth methods, that know all their users.
+type UsersMethod interface {
+	Users() ([]string, error)
+}
+
+// HTTPAuthMethod checks credentials from Proxy-Authorization header with schemes other than Basic.
+type HTTPAuthMethod interface {
+	GetName() string
+
+	Init() error
+	Close() error
+	Scheme() string
+	Challenge(stale bool) string
+	CheckHTTP(method, uri, credentials string) (string, bool, error)
+}
@@ -0,0 +1,83 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package models
+
+import "net"
+
+type BindAddr struct {
+	IP       net.IP
+	Hostname string
+}
+
+func (b *BindAddr) IsHostname() bool {
+	return len(b.Hostname) > 0
+}
+
+func (b *BindAddr) IsIPv4() bool {
+	return b.IP != nil && b.IP.To4() != nil
+}
+
+// Host returns address in form, that can be used in net.JoinHostPort.
+func (b *BindAddr) Host() string {
+	if b.IsHostname() {
+		return b.Hostname
+	}
+
+	return b.IP.String()
+}
+
+// LookupIPv4 returns ipv4 address of bind addr, resolving hostname if needed.
+func (b *BindAddr) LookupIPv4() (net.IP, bool) {
+	if !b.IsHostname() {
+		if t := b.IP.To4(); t != nil {
+			return t, true
+		}
+		return nil, false
+	}
+
+	ips, err := net.LookupIP(b.Hostname)
+	if err != nil {
+		return nil, false
+	}
+	for _, ip := range ips {
+		if t := ip.To4(); t != nil {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+func NewBindAddr(addr string) *BindAddr {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return &BindAddr{Hostname: addr}
+	}
+
+	// Just fix to make sure, that ipv4 have 4 bytes in net.IP slice.
+	if t := ip.To4(); t != nil {
+		ip = t
+	}
+
+	return &BindAddr{IP: ip}
+}
@@ -23,7 +23,10 @@ SOFTWARE. */
 package models
 
 import (
+	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	"virgild/auth"
 )
@@ -32,7 +35,27 @@ type Config struct {
 	Server        ServerConfig
 	AuthSQL       AuthSQLConfig
 	AuthPlainText AuthPlainTextConfig
+	AuthHTTP      AuthHTTPConfig
 	Subnets       SubnetsConfig
+	ProxyProtocol ProxyProtocolConfig
+	Mitm          MitmConfig
+	Pac           PacConfig
+
+	Shadowsocks ShadowsocksConfig
+	WebSocket   WebSocketConfig
+	Mux         MuxConfig
+	Relay       RelayConfig
+	SSH         SSHConfig
+	Quota       QuotaConfig
+	Admin       AdminConfig
+
+	UsernameParams UsernameParamsConfig
+
+	Forward  map[string]*ForwardConfig
+	Upstream map[string]*UpstreamConfig
+	Pool     map[string]*PoolConfig
+	ACL      map[string]*ACLConfig
+	Schedule map[string]*ScheduleConfig
 }
 
 type ServerConfig struct {
@@ -46,21 +69,43 @@ type ServerConfig struct {
 	AllowAnonymous bool
 	AllowHTTP      bool
 
+	Socks4Auth         string
+	Socks4Ident        bool
+	Socks4IdentTrusted []string
+
+	// Don't use it in your config file, please, it's for internal use.
+	Socks4IdentSubnets *SubnetChecker
+
+	HTTPVia             bool
+	HTTPForwardedFor    bool
+	HTTPIdleConnections int
+	HTTP2               bool
+
 	AllowTCPBind      bool
-	TCPBindAddr       string
+	TCPBindAddr       []string
 	TCPBindPortsStart int
 	TCPBindPortsEnd   int
+	TCPBindKeepOpen   int
 
 	// Don't use it in your config file, please, it's for internal use.
-	TCPBindAddrIsHostname bool
-	TCPBindAddrIP         net.IP
-	TCPBindAddrHostname   string
+	TCPBindAddrs []*BindAddr
 
 	AllowUDPAssociation      bool
 	UDPAssociationAddr       string
 	UDPAssociationPortsStart int
 	UDPAssociationPortsEnd   int
 
+	UDPAssociationFiltering   string
+	UDPAssociationFlowTimeout int
+
+	AllowUDPOverTCP bool
+
+	PortsQuarantine int
+	PortsPerUser    int
+
+	TransparentBind string
+	TransparentMode string
+
 	// Don't use it in your config file, please, it's for internal use.
 	UDPAssociationAddrIsHostname bool
 	UDPAssociationAddrIP         net.IP
@@ -78,7 +123,8 @@ type AuthSQLConfig struct {
 	HashMethod   string
 	CacheTimeout int64
 
-	QuerySelectUser string
+	QuerySelectUser           string
+	QuerySelectUserAttributes string
 }
 
 type AuthPlainTextConfig struct {
@@ -86,12 +132,202 @@ type AuthPlainTextConfig struct {
 	HashMethod string
 }
 
+type AuthHTTPConfig struct {
+	DigestFile         string
+	DigestRealm        string
+	DigestNonceTimeout int64
+
+	BearerPublicKey     string
+	BearerTokenFile     string
+	BearerUsernameClaim string
+	BearerIssuer        string
+	BearerAudience      string
+}
+
+type ProxyProtocolConfig struct {
+	Trusted []string
+
+	Send   string
+	SendTo []string
+}
+
 type SubnetsConfig struct {
 	UserWillIgnore bool
 
 	Allow       []string
 	Deny        []string
 	AllowRemote []string
+
+	DenyPrivateRemote  bool
+	AllowPrivateRemote []string
+}
+
+type MitmConfig struct {
+	Enable bool
+	CACert string
+	CAKey  string
+
+	User   []string
+	Port   []int
+	Domain []string
+	Bypass []string
+
+	RemoveHeader []string
+	SetHeader    []string
+	LogHeaders   bool
+}
+
+type ShadowsocksConfig struct {
+	Bind     string
+	Method   string
+	Password string
+	User     []string
+	UDP      bool
+}
+
+type WebSocketConfig struct {
+	Bind       string
+	Path       string
+	Token      string
+	PublicKey  string
+	PrivateKey string
+}
+
+type MuxConfig struct {
+	Bind       string
+	PublicKey  string
+	PrivateKey string
+	Insecure   bool
+}
+
+type RelayConfig struct {
+	Address    string
+	Username   string
+	Password   string
+	Insecure   bool
+	CACert     string
+	ServerName string
+}
+
+type SSHConfig struct {
+	Bind           string
+	HostKey        []string
+	AuthorizedKeys string
+	PasswordAuth   bool
+}
+
+type AdminConfig struct {
+	Bind  string
+	Token string
+
+	// Don't use it in your config file, please, it's for internal use.
+	ConfigPath string
+}
+
+type QuotaConfig struct {
+	Path         string
+	ResetDay     int
+	Timezone     string
+	SaveInterval int
+}
+
+type UsernameParamsConfig struct {
+	Separator string
+	Key       []string
+}
+
+type PoolConfig struct {
+	Address []string
+	// Users and groups of users, that can select pool. Others need it in their "pools" attribute.
+	User  []string
+	Group []string
+
+	// Don't use it in your config file, please, it's for internal use.
+	IPs []net.IP
+}
+
+type ACLConfig struct {
+	Allow []string
+	Deny  []string
+
+	// Don't use it in your config file, please, it's for internal use.
+	AllowSubnets *SubnetChecker
+	DenySubnets  *SubnetChecker
+}
+
+type ScheduleConfig struct {
+	// Weekdays or ranges of them: mon-fri, sat. All days, if empty.
+	Days []string
+	// Time windows: 09:00-18:00, 22:00-06:00. Whole day, if empty.
+	Time     []string
+	Timezone string
+
+	User     []string
+	Group    []string
+	Listener []string
+
+	// Don't use it in your config file, please, it's for internal use.
+	Location *time.Location
+	Weekdays [7]bool
+	Windows  []TimeWindow
+}
+
+type ForwardConfig struct {
+	Bind           string
+	Target         string
+	Upstream       []string
+	MaxConnections int
+	Bandwidth      int64
+
+	// Don't use it in your config file, please, it's for internal use.
+	Upstreams []*UpstreamConfig
+}
+
+type UpstreamConfig struct {
+	Type     string
+	Address  string
+	Username string
+	Password string
+	// Users and groups of users, that can select upstream with "route" parameter. Others need it in their "routes" attribute.
+	User  []string
+	Group []string
+}
+
+type PacConfig struct {
+	Proxy    string
+	Bypass   []string
+	Template string
+}
+
+// LoadPolicy prepares acls and schedules, they can be loaded again by config reload.
+func (c *Config) LoadPolicy() error {
+	for name, acl := range c.ACL {
+		acl.AllowSubnets = &SubnetChecker{}
+		if err := acl.AllowSubnets.Load(acl.Allow); err != nil {
+			return fmt.Errorf("acl %s: %s", name, err)
+		}
+		acl.DenySubnets = &SubnetChecker{}
+		if err := acl.DenySubnets.Load(acl.Deny); err != nil {
+			return fmt.Errorf("acl %s: %s", name, err)
+		}
+	}
+
+	for name, schedule := range c.Schedule {
+		if err := schedule.Load(); err != nil {
+			return fmt.Errorf("schedule %s: %s", name, err)
+		}
+		for _, listener := range schedule.Listener {
+			switch listener {
+			case "server", "websocket", "shadowsocks", "ssh", "mux", "transparent":
+			default:
+				if _, ok := c.Forward[strings.TrimPrefix(listener, "forward:")]; !ok || !strings.HasPrefix(listener, "forward:") {
+					return fmt.Errorf("schedule %s: unknown listener %s", name, listener)
+				}
+			}
+		}
+	}
+
+	return nil
 }
 
 func (c *Config) GetAuthMethods() ([]AuthMethod, error) {
@@ -117,6 +353,7 @@ func (c *Config) GetAuthMethods() ([]AuthMethod, error) {
 			c.AuthSQL.CacheTimeout,
 
 			c.AuthSQL.QuerySelectUser,
+			c.AuthSQL.QuerySelectUserAttributes,
 		)
 		if err != nil {
 			return nil, err
@@ -130,3 +367,37 @@ func (c *Config) GetAuthMethods() ([]AuthMethod, error) {
 
 	return authMethods, nil
 }
+
+func (c *Config) GetHTTPAuthMethods() ([]HTTPAuthMethod, error) {
+	authMethods := []HTTPAuthMethod{}
+	if len(c.AuthHTTP.DigestFile) > 0 {
+		authDigest, err := auth.NewAuthDigest(c.AuthHTTP.DigestFile, c.AuthHTTP.DigestRealm, c.AuthHTTP.DigestNonceTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if err = authDigest.Init(); err != nil {
+			return nil, err
+		}
+
+		authMethods = append(authMethods, authDigest)
+	}
+	if len(c.AuthHTTP.BearerPublicKey) > 0 || len(c.AuthHTTP.BearerTokenFile) > 0 {
+		authBearer, err := auth.NewAuthBearer(
+			c.AuthHTTP.BearerPublicKey,
+			c.AuthHTTP.BearerTokenFile,
+			c.AuthHTTP.BearerUsernameClaim,
+			c.AuthHTTP.BearerIssuer,
+			c.AuthHTTP.BearerAudience,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err = authBearer.Init(); err != nil {
+			return nil, err
+		}
+
+		authMethods = append(authMethods, authBearer)
+	}
+
+	return authMethods, nil
+}
@@ -0,0 +1,174 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a part of day in minutes from midnight. If From isn't less than To,
+// window goes through midnight to the next day.
+type TimeWindow struct {
+	From int
+	To   int
+}
+
+// Load parses days, time windows and timezone of schedule.
+func (c *ScheduleConfig) Load() error {
+	var err error
+	if c.Location, err = time.LoadLocation(c.Timezone); err != nil {
+		return err
+	}
+
+	if len(c.Days) == 0 {
+		for i := range c.Weekdays {
+			c.Weekdays[i] = true
+		}
+	}
+	for _, days := range c.Days {
+		for _, item := range splitList(strings.ToLower(days)) {
+			t := strings.SplitN(item, "-", 2)
+			from, ok := scheduleWeekdays[strings.TrimSpace(t[0])]
+			if !ok {
+				return fmt.Errorf("wrong weekday %s", t[0])
+			}
+			to := from
+			if len(t) == 2 {
+				if to, ok = scheduleWeekdays[strings.TrimSpace(t[1])]; !ok {
+					return fmt.Errorf("wrong weekday %s", t[1])
+				}
+			}
+
+			// Ranges like fri-mon go through the end of week.
+			for day := from; ; day = (day + 1) % 7 {
+				c.Weekdays[day] = true
+				if day == to {
+					break
+				}
+			}
+		}
+	}
+
+	for _, times := range c.Time {
+		for _, item := range splitList(times) {
+			t := strings.SplitN(item, "-", 2)
+			if len(t) != 2 {
+				return fmt.Errorf("wrong time window %s, must be like 09:00-18:00", item)
+			}
+			from, err := parseMinutes(t[0])
+			if err != nil {
+				return err
+			}
+			to, err := parseMinutes(t[1])
+			if err != nil {
+				return err
+			}
+			if from == 24*60 {
+				return fmt.Errorf("wrong time window %s", item)
+			}
+			c.Windows = append(c.Windows, TimeWindow{From: from, To: to})
+		}
+	}
+
+	return nil
+}
+
+func parseMinutes(value string) (int, error) {
+	t := strings.SplitN(strings.TrimSpace(value), ":", 2)
+	if len(t) != 2 {
+		return 0, fmt.Errorf("wrong time %s, must be like 09:00", value)
+	}
+	hours, err := strconv.Atoi(t[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("wrong time %s", value)
+	}
+	minutes, err := strconv.Atoi(t[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("wrong time %s", value)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// Allows checks, that moment is inside of schedule. Window, that goes through midnight,
+// belongs to the day, when it started.
+func (c *ScheduleConfig) Allows(moment time.Time) bool {
+	moment = moment.In(c.Location)
+	day := moment.Weekday()
+	minutes := moment.Hour()*60 + moment.Minute()
+
+	if len(c.Windows) == 0 {
+		return c.Weekdays[day]
+	}
+
+	for _, window := range c.Windows {
+		if window.From < window.To {
+			if c.Weekdays[day] && minutes >= window.From && minutes < window.To {
+				return true
+			}
+			continue
+		}
+
+		if c.Weekdays[day] && minutes >= window.From {
+			return true
+		}
+		if c.Weekdays[(day+6)%7] && minutes < window.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AppliesTo checks, whether schedule is attached to user (directly or by group) or to listener.
+func (c *ScheduleConfig) AppliesTo(name string, user *User, listener string) bool {
+	if contains(c.Listener, listener) {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	if contains(user.Schedules, name) || contains(c.User, user.Name) {
+		return true
+	}
+	for _, group := range c.Group {
+		if user.InGroup(group) {
+			return true
+		}
+	}
+
+	return false
+}
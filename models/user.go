@@ -22,6 +22,175 @@ SOFTWARE. */
 
 package models
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type User struct {
 	Name string
+	// Parameters, sent by client in username (session, pool, route and so on).
+	Params map[string]string
+
+	Groups []string
+	// Allowed commands: connect, bind, udp, for all protocols. Empty - all of them.
+	Commands []string
+	// Allowed protocols: socks4, socks5, http, shadowsocks, ssh, mux. Empty - all of them.
+	Protocols []string
+	// Bytes per second in each direction for all connections of user, 0 - unlimited.
+	Bandwidth int64
+	// Traffic quotas in bytes per day and per month, 0 - unlimited.
+	QuotaDay   int64
+	QuotaMonth int64
+	Expires    time.Time
+	// Names of [acl] sections, that restrict destinations of user.
+	ACL []string
+	// Names of [schedule] sections, that restrict time of access.
+	Schedules []string
+	// Names of [upstream] and [pool] sections, that user can select with username parameters.
+	Routes []string
+	Pools  []string
+}
+
+// NewUser creates user from attributes, stored by auth method. Unknown attributes are ignored.
+func NewUser(name string, attributes map[string]string) (*User, error) {
+	user := &User{Name: name}
+
+	for key, value := range attributes {
+		value = strings.TrimSpace(value)
+		if len(value) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "groups":
+			user.Groups = splitList(value)
+		case "commands":
+			user.Commands = splitList(strings.ToLower(value))
+		case "protocols":
+			user.Protocols = splitList(strings.ToLower(value))
+		case "acl":
+			user.ACL = splitList(value)
+		case "schedule":
+			user.Schedules = splitList(value)
+		case "routes":
+			user.Routes = splitList(value)
+		case "pools":
+			user.Pools = splitList(value)
+		case "bandwidth":
+			bandwidth, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || bandwidth < 0 {
+				return nil, fmt.Errorf("user %s has wrong bandwidth %s", name, value)
+			}
+			user.Bandwidth = bandwidth
+		case "quotaday":
+			quota, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || quota < 0 {
+				return nil, fmt.Errorf("user %s has wrong daily quota %s", name, value)
+			}
+			user.QuotaDay = quota
+		case "quotamonth":
+			quota, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || quota < 0 {
+				return nil, fmt.Errorf("user %s has wrong monthly quota %s", name, value)
+			}
+			user.QuotaMonth = quota
+		case "expires":
+			expires, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				if expires, err = time.Parse(time.RFC3339, value); err != nil {
+					return nil, fmt.Errorf("user %s has wrong expiry date %s", name, value)
+				}
+			}
+			user.Expires = expires
+		}
+	}
+
+	return user, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Param returns parameter of user, it's safe for anonymous (nil) user.
+func (u *User) Param(key string) string {
+	if u == nil {
+		return ""
+	}
+
+	return u.Params[key]
+}
+
+// Key identifies user together with parameters, that change routing of connections.
+func (u *User) Key() string {
+	if u == nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(u.Params))
+	for k, v := range u.Params {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(append([]string{u.Name}, keys...), ";")
+}
+
+// AllowsCommand checks socks command. Anonymous (nil) user has no personal restrictions,
+// only server rules are applied to him.
+func (u *User) AllowsCommand(command string) bool {
+	return u == nil || len(u.Commands) == 0 || contains(u.Commands, command)
+}
+
+func (u *User) AllowsProtocol(protocol string) bool {
+	return u == nil || len(u.Protocols) == 0 || contains(u.Protocols, protocol)
+}
+
+func (u *User) InGroup(group string) bool {
+	return u != nil && contains(u.Groups, group)
+}
+
+// AllowsRoute checks, that user is listed in upstream section, has it in "routes" attribute, or is in one of its groups.
+func (u *User) AllowsRoute(route string, users, groups []string) bool {
+	return u != nil && (contains(users, u.Name) || contains(u.Routes, route) || u.inAnyGroup(groups))
+}
+
+// AllowsPool checks, that user is listed in pool section, has it in "pools" attribute, or is in one of its groups.
+func (u *User) AllowsPool(pool string, users, groups []string) bool {
+	return u != nil && (contains(users, u.Name) || contains(u.Pools, pool) || u.inAnyGroup(groups))
+}
+
+func (u *User) inAnyGroup(groups []string) bool {
+	for _, group := range groups {
+		if u.InGroup(group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *User) Expired() bool {
+	return u != nil && !u.Expires.IsZero() && !time.Now().Before(u.Expires)
 }
@@ -0,0 +1,401 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/gcfg.v1"
+
+	"virgild/models"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// adminListener serves local http api for administration: sessions, users, port leases and config reload.
+type adminListener struct {
+	config   *models.AdminConfig
+	listener net.Listener
+}
+
+type adminSessionInfo struct {
+	ID          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Listener    string    `json:"listener"`
+	Protocol    string    `json:"protocol"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	Started     time.Time `json:"started"`
+	Uploaded    int64     `json:"uploaded"`
+	Downloaded  int64     `json:"downloaded"`
+}
+
+type adminUserInfo struct {
+	Name     string `json:"name"`
+	Locked   bool   `json:"locked"`
+	Sessions int    `json:"sessions"`
+}
+
+type adminPortLease struct {
+	Port  int       `json:"port"`
+	Owner string    `json:"owner"`
+	Since time.Time `json:"since"`
+}
+
+func newAdminListener(config *models.AdminConfig) (*adminListener, error) {
+	listener, err := net.Listen("tcp", config.Bind)
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminListener{config: config, listener: listener}, nil
+}
+
+func (a *adminListener) serve(s *Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminSessions(s, w, r)
+	}))
+	mux.HandleFunc("/sessions/", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminSession(s, w, r)
+	}))
+	mux.HandleFunc("/users", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminUsers(s, w, r)
+	}))
+	mux.HandleFunc("/users/", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminUser(s, w, r)
+	}))
+	mux.HandleFunc("/ports", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminPorts(s, w, r)
+	}))
+	mux.HandleFunc("/reload", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminReload(s, w, r)
+	}))
+	mux.HandleFunc("/stats", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		adminStats(s, w, r)
+	}))
+	// Page itself is public, it asks token and uses it for api requests.
+	mux.HandleFunc("/", adminDashboard)
+
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  time.Duration(s.config.Server.Timeout) * time.Second,
+		WriteTimeout: time.Duration(s.config.Server.Timeout) * time.Second,
+	}
+	if err := server.Serve(a.listener); err != nil && s.work {
+		log.Errorln("(admin)", err)
+	}
+}
+
+func (a *adminListener) Close() error {
+	return a.listener.Close()
+}
+
+// authorized checks token from "Authorization: Bearer" header.
+func (a *adminListener) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if authorization := r.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+			token = authorization[7:]
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+			log.Errorln("client:", r.RemoteAddr, "admin error: wrong token")
+			adminError(w, http.StatusUnauthorized, fmt.Errorf("wrong token"))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func adminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func adminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+
+	return true
+}
+
+// GET /sessions lists active sessions.
+func adminSessions(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	list := s.sessions.list()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	sessions := make([]adminSessionInfo, 0, len(list))
+	for _, sess := range list {
+		sess.mutex.Lock()
+		info := adminSessionInfo{
+			ID:          sess.id,
+			Listener:    sess.listener,
+			Protocol:    sess.protocol,
+			Client:      sess.client,
+			Destination: sess.destination,
+			Started:     sess.started,
+			Uploaded:    atomic.LoadInt64(&sess.uploaded),
+			Downloaded:  atomic.LoadInt64(&sess.downloaded),
+		}
+		if sess.user != nil {
+			info.User = sess.user.Name
+		}
+		sess.mutex.Unlock()
+
+		sessions = append(sessions, info)
+	}
+
+	adminJSON(w, sessions)
+}
+
+// DELETE /sessions/<id> closes session.
+func adminSession(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodDelete) {
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("wrong session id"))
+		return
+	}
+
+	sess := s.sessions.get(id)
+	if sess == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("session %d not found", id))
+		return
+	}
+
+	log.Warnf("(admin) %s closed session %d of %s", r.RemoteAddr, id, sess.client)
+	sess.conn.Close()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /users lists users of auth methods, that know them, locked users and users with sessions.
+func adminUsers(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	users := map[string]*adminUserInfo{}
+	add := func(name string) *adminUserInfo {
+		user, ok := users[name]
+		if !ok {
+			user = &adminUserInfo{Name: name, Locked: s.userLocked(name)}
+			users[name] = user
+		}
+		return user
+	}
+
+	for _, method := range s.allAuthMethods() {
+		if storage, ok := method.(models.UsersMethod); ok {
+			names, err := storage.Users()
+			if err != nil {
+				adminError(w, http.StatusInternalServerError, err)
+				return
+			}
+			for _, name := range names {
+				add(name)
+			}
+		}
+	}
+
+	s.lockedUsersMutex.Lock()
+	locked := make([]string, 0, len(s.lockedUsers))
+	for name := range s.lockedUsers {
+		locked = append(locked, name)
+	}
+	s.lockedUsersMutex.Unlock()
+	for _, name := range locked {
+		add(name)
+	}
+
+	for _, sess := range s.sessions.list() {
+		if user := sess.getUser(); user != nil {
+			add(user.Name).Sessions++
+		}
+	}
+
+	list := make([]*adminUserInfo, 0, len(users))
+	for _, user := range users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	adminJSON(w, list)
+}
+
+// POST /users/<name>/lock and /users/<name>/unlock.
+func adminUser(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/users/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown action"))
+		return
+	}
+	name, action := path[:i], path[i+1:]
+
+	switch action {
+	case "lock":
+		closed := s.lockUser(name)
+		log.Warnf("(admin) %s locked user %s, %d sessions closed", r.RemoteAddr, name, closed)
+		adminJSON(w, map[string]interface{}{"name": name, "locked": true, "closed": closed})
+	case "unlock":
+		s.unlockUser(name)
+		log.Warnf("(admin) %s unlocked user %s", r.RemoteAddr, name)
+		adminJSON(w, map[string]interface{}{"name": name, "locked": false})
+	default:
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown action %s", action))
+	}
+}
+
+// GET /ports lists leases of tcp bind and udp association ports.
+func adminPorts(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	convert := func(leases []PortLease) []adminPortLease {
+		list := make([]adminPortLease, 0, len(leases))
+		for _, lease := range leases {
+			list = append(list, adminPortLease{Port: lease.Port, Owner: lease.Owner, Since: lease.Since})
+		}
+		return list
+	}
+
+	adminJSON(w, map[string][]adminPortLease{
+		"tcp": convert(s.TCPPortLeases()),
+		"udp": convert(s.UDPPortLeases()),
+	})
+}
+
+// POST /reload reads config file again.
+func adminReload(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		log.Errorln("(admin) reload error:", err)
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Warnf("(admin) %s reloaded config", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /stats returns rolling statistics for dashboard.
+func adminStats(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	adminJSON(w, s.stats.report(s.sessions.list()))
+}
+
+// GET / serves dashboard page.
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		adminError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardPage)
+}
+
+// reload applies parts of config, that can be changed at runtime: acls, schedules and users of auth methods.
+// Other changes need restart.
+func (s *Server) reload() error {
+	config := &models.Config{}
+	if err := gcfg.ReadFileInto(config, s.config.Admin.ConfigPath); err != nil {
+		return err
+	}
+	if err := config.LoadPolicy(); err != nil {
+		return err
+	}
+
+	for _, method := range s.allAuthMethods() {
+		if reloader, ok := method.(models.ReloadMethod); ok {
+			if err := reloader.Reload(); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.policyMutex.Lock()
+	s.config.ACL = config.ACL
+	s.config.Schedule = config.Schedule
+	s.policyMutex.Unlock()
+
+	return nil
+}
+
+// allAuthMethods returns auth methods of both kinds, for checks of optional interfaces.
+func (s *Server) allAuthMethods() []interface{} {
+	methods := []interface{}{}
+	for _, method := range s.authMethods {
+		methods = append(methods, method)
+	}
+	for _, method := range s.httpAuthMethods {
+		methods = append(methods, method)
+	}
+
+	return methods
+}
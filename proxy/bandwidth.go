@@ -0,0 +1,106 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"virgild/models"
+)
+
+// bandwidthLimiter is token bucket, shared by all connections (of user or forwarding rule) in one direction.
+type bandwidthLimiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	mutex  *sync.Mutex
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate, tokens: float64(rate), last: time.Now(), mutex: &sync.Mutex{}}
+}
+
+// wait takes n bytes from bucket, sleeping while bucket is in debt.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		// Burst is limited to one second of traffic.
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+type userLimiters struct {
+	upload   *bandwidthLimiter
+	download *bandwidthLimiter
+}
+
+// limitedConn is remote connection with bandwidth limit.
+type limitedConn struct {
+	net.Conn
+	limiters *userLimiters
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiters.download.wait(n)
+	}
+
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.limiters.upload.wait(len(p))
+	return c.Conn.Write(p)
+}
+
+// limitConnection applies bandwidth limit of user to remote connection.
+func (s *Server) limitConnection(user *models.User, conn net.Conn) net.Conn {
+	if user == nil || user.Bandwidth <= 0 {
+		return conn
+	}
+
+	s.limitersMutex.Lock()
+	limiters, ok := s.limiters[user.Name]
+	if !ok || limiters.upload.rate != user.Bandwidth {
+		limiters = &userLimiters{upload: newBandwidthLimiter(user.Bandwidth), download: newBandwidthLimiter(user.Bandwidth)}
+		s.limiters[user.Name] = limiters
+	}
+	s.limitersMutex.Unlock()
+
+	return &limitedConn{Conn: conn, limiters: limiters}
+}
@@ -0,0 +1,150 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// forward is static port forwarding: every connection to bind address goes to target.
+type forward struct {
+	name     string
+	config   *models.ForwardConfig
+	listener net.Listener
+
+	host string
+	port uint16
+
+	connections int64
+	// Bandwidth limit of all connections, nil if unlimited.
+	limiters *userLimiters
+}
+
+func newForward(name string, config *models.ForwardConfig) (*forward, error) {
+	host, port, err := net.SplitHostPort(config.Target)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 0xFFFF {
+		return nil, fmt.Errorf("forward %s has wrong target port", name)
+	}
+
+	listener, err := net.Listen("tcp", config.Bind)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &forward{name: name, config: config, listener: listener, host: host, port: uint16(p)}
+	if config.Bandwidth > 0 {
+		f.limiters = &userLimiters{upload: newBandwidthLimiter(config.Bandwidth), download: newBandwidthLimiter(config.Bandwidth)}
+	}
+
+	return f, nil
+}
+
+func (f *forward) serve(s *Server) {
+	for s.work {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if s.work {
+				log.Errorf("(forward %s) %s", f.name, err)
+			}
+			continue
+		}
+
+		go handleForward(s, f, conn)
+	}
+}
+
+func (f *forward) Close() error {
+	return f.listener.Close()
+}
+
+func handleForward(s *Server, f *forward, conn net.Conn) {
+	defer conn.Close()
+
+	connections := atomic.AddInt64(&f.connections, 1)
+	defer atomic.AddInt64(&f.connections, -1)
+
+	client := conn.RemoteAddr().String()
+	if f.config.MaxConnections > 0 && connections > int64(f.config.MaxConnections) {
+		log.Errorf("client: %s (forward %s) error: too many connections", client, f.name)
+		return
+	}
+
+	if err := checkSubnetsRules(s, nil, conn); err != nil {
+		log.Errorf("client: %s (forward %s) security error: %s", client, f.name, err)
+		return
+	}
+	if err := checkSchedule(s, nil, "forward:"+f.name); err != nil {
+		log.Errorf("client: %s (forward %s) schedule error: %s", client, f.name, err)
+		return
+	}
+	sess := s.sessions.add("forward:"+f.name, conn)
+	defer s.sessions.remove(sess)
+	sess.setProtocol("forward")
+	sess.setDestination(f.config.Target)
+
+	var remote net.Conn
+	var err error
+	if len(f.config.Upstreams) > 0 {
+		var chain []string
+		for _, upstream := range f.config.Upstreams {
+			chain = append(chain, upstream.Address)
+		}
+		log.Infof("%s forwarding to %s via %s (forward %s)", client, f.config.Target, strings.Join(chain, ", "), f.name)
+
+		remote, err = dialUpstream(s, f.config.Upstreams, f.host, f.port)
+	} else {
+		log.Infof("%s forwarding to %s (forward %s)", client, f.config.Target, f.name)
+
+		remote, err = connectHostname(s, nil, f.host, f.port)
+	}
+	if err != nil {
+		log.Errorf("client: %s (forward %s) error: %s", client, f.name, err)
+		return
+	}
+
+	if err = sendProxyProtocol(s, conn, remote); err != nil {
+		remote.Close()
+		log.Errorf("client: %s (forward %s) error: %s", client, f.name, err)
+		return
+	}
+	if f.limiters != nil {
+		remote = &limitedConn{Conn: remote, limiters: f.limiters}
+	}
+
+	go proxyChannel(s.config, sess.conn, remote, nil)
+	proxyChannel(s.config, remote, sess.conn, nil)
+
+	log.Infof("%s forwarding to %s closed (forward %s)", client, f.config.Target, f.name)
+}
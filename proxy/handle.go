@@ -24,6 +24,8 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"net"
 
 	log "github.com/sirupsen/logrus"
@@ -31,17 +33,59 @@ import (
 	"virgild/models"
 )
 
+// acceptConnection replaces client address from PROXY header and starts tls, if configured.
+// Original connection is returned with error.
+func acceptConnection(s *Server, conn net.Conn) (net.Conn, error) {
+	accepted, err := acceptProxyProtocol(s, conn)
+	if err != nil {
+		return conn, err
+	}
+
+	if s.tlsConfig != nil {
+		return tls.Server(accepted, s.tlsConfig), nil
+	}
+
+	return accepted, nil
+}
+
 func handle(s *Server, conn net.Conn) {
+	conn, err := acceptConnection(s, conn)
+	if err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "proxy protocol error:", err)
+		conn.Close()
+		return
+	}
+
+	serveClient(s, conn, "server")
+}
+
+// serveClient detects protocol of accepted client connection and serves it until the end.
+// Listener is the name of entry point for schedules.
+func serveClient(s *Server, conn net.Conn, listener string) {
 	defer conn.Close()
 	defer log.Debugln("Connection from", conn.RemoteAddr().String(), "closed")
 	log.Debugln("New connection from", conn.RemoteAddr().String())
 
-	reader := bufio.NewReader(conn)
-	proxy, err := getProxyClientVersion(s, conn, reader)
+	h2, err := isHTTP2(s, conn)
+	if err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "tls handshake error:", err)
+		return
+	}
+	if h2 {
+		serveHTTP2(s, conn, listener)
+		return
+	}
+
+	sess := s.sessions.add(listener, conn)
+	defer s.sessions.remove(sess)
+
+	reader := bufio.NewReader(sess.conn)
+	proxy, err := getProxyClientVersion(s, sess.conn, reader)
 	if err != nil {
 		log.Errorln("client:", conn.RemoteAddr().String(), "version error:", err)
 		return
 	}
+	sess.setProtocol(clientProtocol(proxy))
 
 	if err = proxy.Handshake(reader); err != nil {
 		log.Errorln("client:", conn.RemoteAddr().String(), "handshake error:", err)
@@ -50,7 +94,17 @@ func handle(s *Server, conn net.Conn) {
 
 	var user *models.User
 	if user, err = proxy.Auth(reader, s.authMethods); err != nil {
-		log.Errorln("client:", conn.RemoteAddr().String(), "auth error:", err)
+		log.Errorln("client:", conn.RemoteAddr().String(), errorStage(err, "auth"), err)
+		if !errors.Is(err, errQuotaExceeded) {
+			s.stats.authFailed()
+		}
+		return
+	}
+
+	sess.setUser(user)
+
+	if err = checkSchedule(s, user, listener); err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "schedule error:", err)
 		return
 	}
 
@@ -61,12 +115,13 @@ func handle(s *Server, conn net.Conn) {
 	}
 
 	if err = proxy.Request(reader); err != nil {
-		log.Errorln("client:", conn.RemoteAddr().String(), "request error:", err)
+		log.Errorln("client:", conn.RemoteAddr().String(), errorStage(err, "request"), err)
 		return
 	}
+	sess.setDestination(clientDestination(proxy))
 
 	if err = proxy.Work(); err != nil {
-		log.Errorln("client:", conn.RemoteAddr().String(), "error:", err)
+		log.Errorln("client:", conn.RemoteAddr().String(), errorStage(err, ""), err)
 		return
 	}
 }
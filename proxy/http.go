@@ -24,28 +24,34 @@ package proxy
 
 import (
 	"bufio"
-	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"strconv"
-	"strings"
 
+	"virgild/auth"
 	"virgild/models"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// How many times client can try to authenticate on one connection.
+const httpAuthAttempts = 3
+
 type httpClient struct {
 	server *Server
 	config *models.Config
 	conn   net.Conn
+	reader *bufio.Reader
 	user   *models.User
 
-	command  string
+	request  *http.Request
 	hostname string
 	port     int
+	pac      bool
 
-	headers   []byte
 	proxyAuth string
 }
 
@@ -53,136 +59,98 @@ func (h *httpClient) Answer(status string) []byte {
 	return []byte("HTTP/1.1 " + status + "\r\nProxy-Agent: virgild\r\n\r\n")
 }
 
-func (h *httpClient) ReadCommand(reader *bufio.Reader) error {
-	var buffer []byte
-	var err error
-	if buffer, err = reader.ReadBytes(' '); err != nil {
-		return err
-	}
-	h.command = string(buffer[0 : len(buffer)-1])
+// route returns host and port, where request must be sent.
+func (h *httpClient) route(request *http.Request) (string, int, error) {
+	if request.Method == http.MethodConnect {
+		host, port, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			return "", 0, fmt.Errorf("http client send wrong host and/or port")
+		}
 
-	if buffer, err = reader.ReadBytes(' '); err != nil {
-		return err
-	}
-	h.hostname = string(buffer[0 : len(buffer)-1])
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 0xFFFF {
+			return "", 0, fmt.Errorf("http client send wrong port")
+		}
 
-	if _, err = reader.ReadBytes('\n'); err != nil {
-		return err
+		return host, p, nil
 	}
 
-	return nil
-}
-
-func (h *httpClient) ReadHeaders(reader *bufio.Reader) error {
-	var buffer []byte
-	var line string
-	var err error
-
-	for {
-		if buffer, err = reader.ReadBytes('\n'); err != nil {
-			return err
-		}
-		if len(buffer) <= 2 {
-			break
-		}
+	if !request.URL.IsAbs() || len(request.URL.Host) == 0 {
+		return "", 0, fmt.Errorf("http client send request without absolute uri")
+	}
+	if request.URL.Scheme != "http" {
+		return "", 0, fmt.Errorf("http client send request with unsupported scheme \"%s\"", request.URL.Scheme)
+	}
 
-		line = string(buffer[0 : len(buffer)-2])
-		if strings.HasPrefix(strings.ToLower(line), "proxy-authorization: ") {
-			h.proxyAuth = line[21:]
-		} else {
-			h.headers = append(h.headers, buffer...)
+	port := 80
+	if len(request.URL.Port()) > 0 {
+		var err error
+		if port, err = strconv.Atoi(request.URL.Port()); err != nil || port <= 0 || port > 0xFFFF {
+			return "", 0, fmt.Errorf("http client send wrong port")
 		}
 	}
 
-	h.headers = append(h.headers, '\r')
-	h.headers = append(h.headers, '\n')
-
-	return nil
+	return request.URL.Hostname(), port, nil
 }
 
 func (h *httpClient) Handshake(reader *bufio.Reader) error {
 	var err error
-	if err = h.ReadCommand(reader); err != nil {
-		return err
-	}
-	if err = h.ReadHeaders(reader); err != nil {
+	h.reader = reader
+	if h.request, err = http.ReadRequest(reader); err != nil {
 		return err
 	}
 
-	if h.command == "CONNECT" {
-		tmp := strings.SplitN(h.hostname, ":", 2)
-		if len(tmp) != 2 {
-			return fmt.Errorf("http client send wrong host and/or port")
-		}
+	h.proxyAuth = h.request.Header.Get("Proxy-Authorization")
 
-		h.hostname = tmp[0]
-		if h.port, err = strconv.Atoi(tmp[1]); err != nil {
-			return err
-		}
-	} else {
-		tmp := strings.SplitN(h.hostname, "/", 4)
-		if len(tmp) < 4 {
-			return fmt.Errorf("http client send wrong hostname")
-		}
-
-		h.hostname = tmp[2]
-		h.port = 80
+	// Browsers ask for proxy auto-config directly, not as a proxy request.
+	if isPACRequest(h.request) {
+		h.pac = true
+		return nil
+	}
 
-		h.headers = append([]byte(fmt.Sprintf("%s /%s HTTP/1.1\r\n", h.command, tmp[3])), h.headers...)
+	if h.hostname, h.port, err = h.route(h.request); err != nil {
+		h.conn.Write(h.Answer("400 Bad Request"))
+		return err
 	}
 
 	return nil
 }
 
-func (h *httpClient) GetUserPassword() (string, string, error) {
-	if len(h.proxyAuth) == 0 {
-		return "", "", fmt.Errorf("http client don't provide authentication credentials")
-	}
-
-	if strings.HasSuffix(strings.ToLower(h.proxyAuth), "basic ") {
-		return "", "", fmt.Errorf("http client authentication not looks like \"Basic\"")
-	}
-
-	baseDecoded, err := base64.StdEncoding.DecodeString(h.proxyAuth[6:])
-	if err != nil {
-		return "", "", err
-	}
-
-	credentials := strings.SplitN(string(baseDecoded), ":", 2)
-	if len(credentials) != 2 {
-		return "", "", fmt.Errorf("http client authentication credentials can't be extracted")
+func (h *httpClient) Auth(reader *bufio.Reader, authMethods []models.AuthMethod) (*models.User, error) {
+	// Proxy auto-config must be available without authentication.
+	if h.pac {
+		return nil, nil
 	}
 
-	return credentials[0], credentials[1], nil
-}
+	// Client may try again on the same connection after our challenge (digest always does it).
+	for attempt := 0; ; attempt++ {
+		user, status, err := authenticateHTTP(h.server, h.request.Method, h.request.RequestURI, h.proxyAuth)
+		if err == nil {
+			h.user = user
+			return h.user, nil
+		}
 
-func (h *httpClient) Auth(reader *bufio.Reader, authMethods []models.AuthMethod) (*models.User, error) {
-	username, password, err := h.GetUserPassword()
-	if err != nil {
-		if !h.config.Server.AllowAnonymous {
-			h.conn.Write(h.Answer("407 Proxy Authentication Required\r\nProxy-Authenticate: Basic"))
+		if status != http.StatusProxyAuthRequired || attempt >= httpAuthAttempts {
+			h.conn.Write(h.Answer(fmt.Sprintf("%d %s", status, http.StatusText(status))))
 			return nil, err
 		}
-	} else {
-		ok := false
-		for _, method := range authMethods {
-			ok, err = method.Check(username, password)
-			if err != nil {
-				log.Errorln("(auth)", err)
-			}
-			if ok {
-				h.user = &models.User{Name: username}
-				return h.user, nil
-			}
+
+		answer := "407 Proxy Authentication Required"
+		for _, challenge := range httpAuthChallenges(h.server, err == auth.ErrStaleNonce) {
+			answer += "\r\nProxy-Authenticate: " + challenge
 		}
+		h.conn.Write(h.Answer(answer + "\r\nContent-Length: 0"))
 
-		if !ok {
-			h.conn.Write(h.Answer("403 Forbidden"))
-			return nil, fmt.Errorf("socks5 client with username: \"%s\" and password: \"%s\" don't exists in our db", username, password)
+		if h.request.Body != nil {
+			io.Copy(ioutil.Discard, h.request.Body)
+		}
+		if err = h.Handshake(reader); err != nil {
+			return nil, err
+		}
+		if h.pac {
+			return nil, nil
 		}
 	}
-
-	return nil, nil
 }
 
 func (h *httpClient) Request(reader *bufio.Reader) error {
@@ -197,8 +165,26 @@ func (h *httpClient) Work() error {
 		client = h.conn.RemoteAddr().String()
 	}
 
+	if h.pac {
+		return h.servePAC(client)
+	}
+
+	// Forwarded requests are outgoing tcp connections too.
+	if err := checkUserCommand(h.user, "connect"); err != nil {
+		h.conn.Write(h.Answer("403 Forbidden"))
+		return err
+	}
+
+	if h.request.Method != http.MethodConnect {
+		return h.forward(client)
+	}
+
 	log.Infof("%s connecting to %s:%d", client, h.hostname, h.port)
 
+	return h.connect(client)
+}
+
+func (h *httpClient) connect(client string) error {
 	var err error
 	var remote net.Conn
 	if remote, err = connectHostname(h.server, h.user, h.hostname, uint16(h.port)); err != nil {
@@ -206,14 +192,10 @@ func (h *httpClient) Work() error {
 		return err
 	}
 
-	if h.command == "CONNECT" {
-		h.conn.Write(h.Answer("200 Connection Established"))
-	} else {
-		remote.Write(h.headers)
-	}
+	h.conn.Write(h.Answer("200 Connection Established"))
 
-	go proxyChannel(h.config, h.conn, remote)
-	proxyChannel(h.config, remote, h.conn)
+	// Client may send data right after CONNECT request, so don't lose buffered part.
+	conn := &bufferedConn{Conn: h.conn, reader: h.reader}
 
-	return nil
+	return proxyConnection(h.server, h.user, client, conn, remote, h.hostname, uint16(h.port))
 }
@@ -0,0 +1,292 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+
+	"virgild/auth"
+)
+
+// http2StreamConn is one CONNECT stream of http/2 connection, so it can be proxied as usual connection.
+type http2StreamConn struct {
+	conn   net.Conn
+	body   io.ReadCloser
+	writer http.ResponseWriter
+
+	// Stream can't be written after handler returned, so Close waits for the last Write.
+	mutex  *sync.Mutex
+	closed bool
+}
+
+type http2Deadliner interface {
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
+}
+
+func (c *http2StreamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *http2StreamConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	c.writer.(http.Flusher).Flush()
+
+	return n, nil
+}
+
+func (c *http2StreamConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	return c.body.Close()
+}
+
+func (c *http2StreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *http2StreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *http2StreamConn) SetDeadline(deadline time.Time) error {
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(deadline)
+}
+
+func (c *http2StreamConn) SetReadDeadline(deadline time.Time) error {
+	if d, ok := c.writer.(http2Deadliner); ok {
+		return d.SetReadDeadline(deadline)
+	}
+	return nil
+}
+
+func (c *http2StreamConn) SetWriteDeadline(deadline time.Time) error {
+	if d, ok := c.writer.(http2Deadliner); ok {
+		return d.SetWriteDeadline(deadline)
+	}
+	return nil
+}
+
+// isHTTP2 makes tls handshake and checks, whether client negotiated http/2 via ALPN.
+func isHTTP2(s *Server, conn net.Conn) (bool, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || !s.config.Server.AllowHTTP || !s.config.Server.HTTP2 {
+		return false, nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return false, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS, nil
+}
+
+// serveHTTP2 handles http/2 client. Every stream is checked separately, like new http/1.1 connection.
+func serveHTTP2(s *Server, conn net.Conn, listener string) {
+	server := &http2.Server{
+		IdleTimeout: time.Duration(s.config.Server.Timeout) * time.Second,
+	}
+
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := serveHTTP2Stream(s, conn, listener, w, r); err != nil {
+				log.Errorln("client:", conn.RemoteAddr().String(), errorStage(err, "http2 stream"), err)
+			}
+		}),
+	})
+}
+
+func serveHTTP2Stream(s *Server, conn net.Conn, listener string, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Proxy-Agent", "virgild")
+
+	user, status, err := authenticateHTTP(s, r.Method, r.RequestURI, r.Header.Get("Proxy-Authorization"))
+	if err != nil {
+		// Request without credentials is the first step of authentication, not a failure.
+		if status == http.StatusProxyAuthRequired && len(r.Header.Get("Proxy-Authorization")) > 0 {
+			s.stats.authFailed()
+		}
+		if status == http.StatusProxyAuthRequired {
+			for _, challenge := range httpAuthChallenges(s, err == auth.ErrStaleNonce) {
+				w.Header().Add("Proxy-Authenticate", challenge)
+			}
+		}
+		w.WriteHeader(status)
+		return err
+	}
+
+	if err = checkSchedule(s, user, listener); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return err
+	}
+
+	if err = checkSubnetsRules(s, user, conn); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return err
+	}
+
+	h := &httpClient{server: s, config: s.config, conn: conn, user: user, request: r}
+
+	var client string
+	if user != nil {
+		client = fmt.Sprintf("%s(%s)", conn.RemoteAddr().String(), user.Name)
+	} else {
+		client = conn.RemoteAddr().String()
+	}
+
+	if err = checkUserCommand(user, "connect"); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return err
+	}
+
+	if r.Method != http.MethodConnect {
+		return h.forwardHTTP2(client, w, r)
+	}
+
+	// Extended CONNECT (RFC 8441, websockets over http/2 and so on) isn't a tunnel to host:port.
+	// Http/2 server doesn't announce it and refuses such streams itself, it's checked in case it will.
+	if len(r.URL.Path) > 0 || len(r.Header.Get(":protocol")) > 0 {
+		w.WriteHeader(http.StatusNotImplemented)
+		return fmt.Errorf("http2 client send unsupported extended CONNECT")
+	}
+
+	if h.hostname, h.port, err = h.route(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+
+	log.Infof("%s connecting to %s:%d (http2)", client, h.hostname, h.port)
+
+	remote, err := connectHostname(s, user, h.hostname, uint16(h.port))
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	stream := &http2StreamConn{conn: conn, body: r.Body, writer: w, mutex: &sync.Mutex{}}
+	defer stream.Close()
+
+	// Only tunnels are registered, other streams are short.
+	sess := s.sessions.add(listener, stream)
+	defer s.sessions.remove(sess)
+	sess.setUser(user)
+	sess.setProtocol("http2")
+	sess.setDestination(net.JoinHostPort(h.hostname, strconv.Itoa(h.port)))
+
+	return proxyConnection(s, user, client, sess.conn, remote, h.hostname, uint16(h.port))
+}
+
+// forwardHTTP2 sends plain http request, which came as http/2 stream with :scheme http.
+func (h *httpClient) forwardHTTP2(client string, w http.ResponseWriter, r *http.Request) error {
+	// Http/2 server sets tls state only for :scheme https. Such request must go through CONNECT,
+	// we won't send it to upstream in plaintext.
+	if r.TLS != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return fmt.Errorf("http2 client send request with unsupported scheme https")
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+
+	host, port, err := h.route(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+
+	log.Infof("%s requesting %s %s (%s:%d, http2)", client, r.Method, r.URL.String(), host, port)
+
+	request := r.Clone(r.Context())
+	request.RequestURI = ""
+	removeHopByHopHeaders(request.Header)
+
+	if h.config.Server.HTTPVia {
+		addVia(request.Header)
+	}
+	if h.config.Server.HTTPForwardedFor {
+		clientIP := clientHost(h.conn)
+		if prior := request.Header.Get("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = prior + ", " + clientIP
+		}
+		request.Header.Set("X-Forwarded-For", clientIP)
+	} else {
+		request.Header.Del("X-Forwarded-For")
+	}
+
+	usage := h.server.quota.usage(h.user)
+	if usage != nil && request.Body != nil {
+		request.Body = &quotaReader{ReadCloser: request.Body, usage: usage}
+	}
+
+	response, err := h.server.getHTTPTransport(h.user).RoundTrip(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+	defer response.Body.Close()
+	if usage != nil {
+		response.Body = &quotaReader{ReadCloser: response.Body, usage: usage}
+	}
+
+	removeHopByHopHeaders(response.Header)
+	if h.config.Server.HTTPVia {
+		addVia(response.Header)
+	}
+
+	header := w.Header()
+	for key, values := range response.Header {
+		header[key] = values
+	}
+	w.WriteHeader(response.StatusCode)
+
+	_, err = io.Copy(w, response.Body)
+	return err
+}
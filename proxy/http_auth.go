@@ -0,0 +1,150 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/auth"
+	"virgild/models"
+)
+
+func splitAuthorization(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	t := strings.SplitN(value, " ", 2)
+	if len(t) != 2 {
+		return value, ""
+	}
+
+	return t[0], strings.TrimSpace(t[1])
+}
+
+func parseBasicCredentials(credentials string) (string, string, error) {
+	baseDecoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", err
+	}
+
+	t := strings.SplitN(string(baseDecoded), ":", 2)
+	if len(t) != 2 {
+		return "", "", fmt.Errorf("http client authentication credentials can't be extracted")
+	}
+
+	return t[0], t[1], nil
+}
+
+func httpAuthChallenges(s *Server, stale bool) []string {
+	challenges := []string{}
+	for _, method := range s.httpAuthMethods {
+		challenges = append(challenges, method.Challenge(stale))
+	}
+	if len(s.authMethods) > 0 {
+		challenges = append(challenges, "Basic realm=\"virgild\"")
+	}
+
+	return challenges
+}
+
+// authenticateHTTP checks value of Proxy-Authorization header. If error returned, status is the http
+// status code for client: 407 means, that client must get our challenges and try again.
+func authenticateHTTP(s *Server, method, uri, proxyAuth string) (*models.User, int, error) {
+	user, status, err := checkHTTPCredentials(s, method, uri, proxyAuth)
+	if err != nil {
+		return nil, status, err
+	}
+
+	if err = checkUserProtocol(user, "http"); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if err = checkUserQuota(s, user); err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+
+	return user, 0, nil
+}
+
+func checkHTTPCredentials(s *Server, method, uri, proxyAuth string) (*models.User, int, error) {
+	scheme, credentials := splitAuthorization(proxyAuth)
+	if len(scheme) == 0 {
+		if s.config.Server.AllowAnonymous {
+			return nil, 0, nil
+		}
+		return nil, http.StatusProxyAuthRequired, fmt.Errorf("http client don't provide authentication credentials")
+	}
+
+	if strings.EqualFold(scheme, "Basic") {
+		username, password, err := parseBasicCredentials(credentials)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		username, params, err := splitUsername(s, username)
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+
+		if user, ok := checkPassword(s, s.authMethods, username, password); ok {
+			user.Params = params
+			if err = checkUserParams(s, user); err != nil {
+				return nil, http.StatusForbidden, err
+			}
+			return user, 0, nil
+		}
+
+		return nil, http.StatusForbidden, fmt.Errorf("http client with username: \"%s\" don't exists in our db or password is wrong", username)
+	}
+
+	supported := false
+	for _, m := range s.httpAuthMethods {
+		if !strings.EqualFold(m.Scheme(), scheme) {
+			continue
+		}
+		supported = true
+
+		username, ok, err := m.CheckHTTP(method, uri, credentials)
+		if err == auth.ErrStaleNonce {
+			return nil, http.StatusProxyAuthRequired, err
+		}
+		if err != nil {
+			log.Errorf("(%s auth) %s", m.GetName(), err)
+		}
+		if ok {
+			user, err := loadUser(s, username)
+			if err != nil {
+				return nil, http.StatusForbidden, err
+			}
+			return user, 0, nil
+		}
+	}
+
+	if !supported {
+		return nil, http.StatusProxyAuthRequired, fmt.Errorf("http client authentication scheme \"%s\" not supported", scheme)
+	}
+
+	return nil, http.StatusForbidden, fmt.Errorf("http client %s credentials are wrong", scheme)
+}
@@ -0,0 +1,285 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// Headers, that make sense only for a single connection, and must not be forwarded by proxy (RFC 7230).
+var httpHopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const httpVia = "1.1 virgild"
+
+// Rest of request body, that upstream didn't read, is skipped up to this size, else connection is closed.
+const httpBodyDrainLimit = 256 * 1024
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range httpHopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+func addVia(header http.Header) {
+	if via := header.Get("Via"); len(via) > 0 {
+		header.Set("Via", via+", "+httpVia)
+	} else {
+		header.Set("Via", httpVia)
+	}
+}
+
+// httpBodyReader moves read deadline of client connection forward on every read, so long uploads will work.
+// It's read by transport in other goroutine, so end of body is flagged atomically.
+type httpBodyReader struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+	eof     int32
+}
+
+func (h *httpBodyReader) Read(p []byte) (int, error) {
+	h.conn.SetReadDeadline(time.Now().Add(h.timeout))
+	n, err := h.ReadCloser.Read(p)
+	if err == io.EOF {
+		atomic.StoreInt32(&h.eof, 1)
+	}
+	return n, err
+}
+
+// drain skips unread rest of body (through body, that may wrap reader), so the next request on
+// connection starts right after it. False means, that body wasn't read till the end.
+func (h *httpBodyReader) drain(body io.Reader) bool {
+	if atomic.LoadInt32(&h.eof) == 1 {
+		return true
+	}
+
+	_, err := io.CopyN(ioutil.Discard, body, httpBodyDrainLimit)
+	return err == io.EOF
+}
+
+// getHTTPTransport returns pool of upstream connections. Pools are separated by user, because
+// connections are checked by security rules only once, when they are established.
+func (s *Server) getHTTPTransport(user *models.User) *http.Transport {
+	// Parameters of user can change routing, so they get own pool too.
+	key := user.Key()
+
+	s.httpTransportsMutex.Lock()
+	defer s.httpTransportsMutex.Unlock()
+
+	transport, ok := s.httpTransports[key]
+	if !ok {
+		timeout := time.Duration(s.config.Server.Timeout) * time.Second
+
+		transport = &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				p, err := strconv.Atoi(port)
+				if err != nil {
+					return nil, err
+				}
+
+				return connectHostname(s, user, host, uint16(p))
+			},
+			DisableCompression:    true,
+			MaxIdleConnsPerHost:   s.config.Server.HTTPIdleConnections,
+			IdleConnTimeout:       timeout,
+			ResponseHeaderTimeout: timeout,
+		}
+		s.httpTransports[key] = transport
+	}
+
+	return transport
+}
+
+func (s *Server) closeHTTPTransports() {
+	s.httpTransportsMutex.Lock()
+	defer s.httpTransportsMutex.Unlock()
+
+	for _, transport := range s.httpTransports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// forward handles plain http requests until client closes connection or asks for CONNECT.
+func (h *httpClient) forward(client string) error {
+	timeoutDuration := time.Duration(h.config.Server.Timeout) * time.Second
+	transport := h.server.getHTTPTransport(h.user)
+	usage := h.server.quota.usage(h.user)
+
+	request := h.request
+	for {
+		if request.Method == http.MethodConnect {
+			var err error
+			if h.hostname, h.port, err = h.route(request); err != nil {
+				h.conn.Write(h.Answer("400 Bad Request"))
+				return err
+			}
+
+			log.Infof("%s connecting to %s:%d", client, h.hostname, h.port)
+			return h.connect(client)
+		}
+
+		closeAfter, err := h.roundTrip(client, transport, request, usage)
+		if err != nil || closeAfter {
+			return err
+		}
+
+		h.conn.SetReadDeadline(time.Now().Add(timeoutDuration))
+		if request, err = http.ReadRequest(h.reader); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (h *httpClient) roundTrip(client string, transport *http.Transport, request *http.Request, usage *quotaUsage) (bool, error) {
+	host, port, err := h.route(request)
+	if err != nil {
+		h.conn.Write(h.Answer("400 Bad Request"))
+		return true, err
+	}
+
+	log.Infof("%s requesting %s %s (%s:%d)", client, request.Method, request.URL.String(), host, port)
+
+	// Quota may be spent by previous requests on this connection.
+	if usage != nil {
+		if err = usage.check(); err != nil {
+			h.conn.Write(h.Answer("429 Too Many Requests\r\nContent-Length: 0\r\nConnection: close"))
+			return true, err
+		}
+	}
+
+	clientClose := request.Close
+
+	if strings.EqualFold(request.Header.Get("Expect"), "100-continue") {
+		request.Header.Del("Expect")
+		h.conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	}
+
+	// Request must be sent to upstream server in origin-form.
+	request.RequestURI = ""
+	request.Close = false
+	request.Host = request.URL.Host
+	removeHopByHopHeaders(request.Header)
+
+	if h.config.Server.HTTPVia {
+		addVia(request.Header)
+	}
+	if h.config.Server.HTTPForwardedFor {
+		clientIP := clientHost(h.conn)
+		if prior := request.Header.Get("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = prior + ", " + clientIP
+		}
+		request.Header.Set("X-Forwarded-For", clientIP)
+	} else {
+		request.Header.Del("X-Forwarded-For")
+	}
+
+	var bodyReader *httpBodyReader
+	if request.Body != nil {
+		bodyReader = &httpBodyReader{
+			ReadCloser: request.Body,
+			conn:       h.conn,
+			timeout:    time.Duration(h.config.Server.Timeout) * time.Second,
+		}
+		request.Body = bodyReader
+		if usage != nil {
+			request.Body = &quotaReader{ReadCloser: request.Body, usage: usage}
+		}
+	}
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		h.conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nProxy-Agent: virgild\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return true, err
+	}
+	defer response.Body.Close()
+	if usage != nil {
+		response.Body = &quotaReader{ReadCloser: response.Body, usage: usage}
+	}
+
+	// We talk to client with our own http version, whatever upstream server uses.
+	response.Proto, response.ProtoMajor, response.ProtoMinor = "HTTP/1.1", 1, 1
+
+	removeHopByHopHeaders(response.Header)
+	if h.config.Server.HTTPVia {
+		addVia(response.Header)
+	}
+
+	// Body without length is terminated by closing connection, so we will do the same.
+	unknownLength := response.ContentLength < 0 && len(response.TransferEncoding) == 0 &&
+		request.Method != http.MethodHead && response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified
+	response.Close = clientClose || unknownLength
+
+	// Upstream may answer (413, 401) before it reads the whole body, its rest must not be taken
+	// for the next request.
+	if bodyReader != nil && !response.Close && !bodyReader.drain(request.Body) {
+		response.Close = true
+	}
+
+	if err = response.Write(h.conn); err != nil {
+		return true, fmt.Errorf("http response write failed: %w", err)
+	}
+
+	return response.Close, nil
+}
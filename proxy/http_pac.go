@@ -0,0 +1,125 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const pacDefaultTemplate = `function FindProxyForURL(url, host) {
+{{- range .Bypass}}
+	if ({{.}}) {
+		return "DIRECT";
+	}
+{{- end}}
+
+	return "{{.Proxy}}";
+}
+`
+
+type pacData struct {
+	Address string
+	Proxy   string
+	Bypass  []string
+}
+
+func isPACRequest(request *http.Request) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if request.URL.IsAbs() {
+		return false
+	}
+
+	return request.URL.Path == "/proxy.pac" || request.URL.Path == "/wpad.dat"
+}
+
+// pacCondition converts bypass rule (subnet, domain or pattern) to javascript condition.
+func pacCondition(rule string) string {
+	if rule == "<local>" {
+		return "isPlainHostName(host)"
+	}
+
+	if ip, subnet, err := net.ParseCIDR(rule); err == nil {
+		if ip.To4() != nil {
+			return fmt.Sprintf("isInNet(host, \"%s\", \"%s\")", subnet.IP.String(), net.IP(subnet.Mask).String())
+		}
+		return fmt.Sprintf("isInNetEx(host, \"%s\")", subnet.String())
+	}
+
+	if strings.ContainsAny(rule, "*?") {
+		return fmt.Sprintf("shExpMatch(host, \"%s\")", rule)
+	}
+
+	rule = strings.TrimPrefix(rule, ".")
+	return fmt.Sprintf("host == \"%s\" || dnsDomainIs(host, \".%s\")", rule, rule)
+}
+
+func newPACTemplate(file string) (*template.Template, error) {
+	if len(file) == 0 {
+		return template.New("pac").Parse(pacDefaultTemplate)
+	}
+
+	return template.ParseFiles(file)
+}
+
+func (h *httpClient) servePAC(client string) error {
+	address := h.config.Pac.Proxy
+	if len(address) == 0 {
+		// Client reached us via this address, so it's the best guess.
+		address = h.conn.LocalAddr().String()
+	}
+
+	data := &pacData{Address: address}
+	if h.server.tls {
+		data.Proxy = fmt.Sprintf("HTTPS %s", address)
+	} else {
+		data.Proxy = fmt.Sprintf("PROXY %s; SOCKS5 %s; SOCKS %s", address, address, address)
+	}
+	for _, rule := range h.config.Pac.Bypass {
+		data.Bypass = append(data.Bypass, pacCondition(rule))
+	}
+
+	var body bytes.Buffer
+	if err := h.server.pacTemplate.Execute(&body, data); err != nil {
+		h.conn.Write(h.Answer("500 Internal Server Error"))
+		return err
+	}
+
+	log.Infof("%s requested %s", client, h.request.URL.Path)
+
+	header := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", body.Len())
+	h.conn.Write([]byte(header))
+	if h.request.Method != http.MethodHead {
+		h.conn.Write(body.Bytes())
+	}
+
+	return nil
+}
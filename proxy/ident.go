@@ -0,0 +1,115 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"virgild/models"
+)
+
+// identLookup asks ident server (RFC 1413) on client host, who owns connection.
+// Ident answer is controlled by client host, so it's trustworthy only in managed networks.
+func identLookup(conn net.Conn, timeout time.Duration) (string, error) {
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("ident lookup needs tcp client")
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("ident lookup needs tcp client")
+	}
+
+	ident, err := net.DialTimeout("tcp", net.JoinHostPort(client.IP.String(), "113"), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer ident.Close()
+
+	ident.SetDeadline(time.Now().Add(timeout))
+	if _, err = fmt.Fprintf(ident, "%d , %d\r\n", client.Port, local.Port); err != nil {
+		return "", err
+	}
+
+	// Answer looks like: "6193, 23 : USERID : UNIX : stjohns"
+	line, err := bufio.NewReader(ident).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(parts) < 3 {
+		return "", fmt.Errorf("wrong ident answer")
+	}
+
+	ports := strings.Split(parts[0], ",")
+	if len(ports) != 2 || strings.TrimSpace(ports[0]) != strconv.Itoa(client.Port) || strings.TrimSpace(ports[1]) != strconv.Itoa(local.Port) {
+		return "", fmt.Errorf("ident answer for wrong connection")
+	}
+
+	if strings.TrimSpace(parts[1]) != "USERID" || len(parts) != 4 {
+		return "", fmt.Errorf("ident error: %s", strings.TrimSpace(parts[len(parts)-1]))
+	}
+
+	// User id is taken as is, only leading space is removed (RFC 1413).
+	userID := strings.TrimLeft(parts[3], " ")
+	if len(userID) == 0 {
+		return "", fmt.Errorf("ident answer with empty user id")
+	}
+
+	return userID, nil
+}
+
+// knownUser checks, that some auth method has user with this name, for names, that weren't authenticated
+// by password or token (ident answer).
+func knownUser(s *Server, name string) (bool, error) {
+	for _, method := range s.allAuthMethods() {
+		if storage, ok := method.(models.UsersMethod); ok {
+			names, err := storage.Users()
+			if err != nil {
+				return false, err
+			}
+			for _, n := range names {
+				if n == name {
+					return true, nil
+				}
+			}
+		}
+
+		if storage, ok := method.(models.AttributesMethod); ok {
+			attributes, err := storage.Attributes(name)
+			if err != nil {
+				return false, err
+			}
+			if attributes != nil {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,396 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+const mitmCertificateLifetime = 7 * 24 * time.Hour
+
+// Issued certificates are cached for so many hosts, the least recently used are dropped.
+const mitmCertificateCache = 1024
+
+type mitmCertificate struct {
+	host string
+	cert *tls.Certificate
+}
+
+type mitm struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey
+
+	// Values of certs are elements of certsOrder, the most recently used are in front.
+	certs      map[string]*list.Element
+	certsOrder *list.List
+	certsMutex *sync.Mutex
+
+	users   map[string]bool
+	ports   map[int]bool
+	domains []string
+	bypass  []string
+
+	removeHeaders []string
+	setHeaders    [][2]string
+	logHeaders    bool
+}
+
+// peekConn remembers everything, that was read, and ignores writes. It's used to get
+// server name from tls ClientHello without breaking connection.
+type peekConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (p *peekConn) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	p.buffer.Write(b[:n])
+	return n, err
+}
+
+func (p *peekConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func peekServerName(conn net.Conn) (string, bool, net.Conn) {
+	peek := &peekConn{Conn: conn}
+
+	var serverName string
+	var isTLS bool
+	tls.Server(peek, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			isTLS = true
+			return nil, fmt.Errorf("client hello received")
+		},
+	}).Handshake()
+
+	return serverName, isTLS, &bufferedConn{Conn: conn, reader: bufio.NewReader(io.MultiReader(&peek.buffer, conn))}
+}
+
+func matchDomain(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "*."))
+		if pattern == "*" || host == pattern || strings.HasSuffix(host, "."+pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *mitm) applies(user *models.User, port uint16) bool {
+	if !m.ports[int(port)] {
+		return false
+	}
+	if len(m.users) == 0 {
+		return true
+	}
+	if user == nil {
+		return m.users["anonymous"]
+	}
+
+	return m.users[user.Name]
+}
+
+func (m *mitm) matchHost(host string) bool {
+	if matchDomain(m.bypass, host) {
+		return false
+	}
+
+	return len(m.domains) == 0 || matchDomain(m.domains, host)
+}
+
+func (m *mitm) certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	// Server name comes from client, certificates are issued only for hosts, that we intercept.
+	if !m.matchHost(host) {
+		return nil, fmt.Errorf("host %s must not be intercepted", host)
+	}
+
+	m.certsMutex.Lock()
+	defer m.certsMutex.Unlock()
+
+	if element, ok := m.certs[host]; ok {
+		cert := element.Value.(*mitmCertificate).cert
+		if time.Now().Before(cert.Leaf.NotAfter.Add(-time.Hour)) {
+			m.certsOrder.MoveToFront(element)
+			return cert, nil
+		}
+		m.certsOrder.Remove(element)
+		delete(m.certs, host)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(mitmCertificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(m.ca.NotAfter) {
+		template.NotAfter = m.ca.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, &m.key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Raw},
+		PrivateKey:  m.key,
+		Leaf:        leaf,
+	}
+	m.certs[host] = m.certsOrder.PushFront(&mitmCertificate{host: host, cert: cert})
+	for m.certsOrder.Len() > mitmCertificateCache {
+		oldest := m.certsOrder.Back()
+		m.certsOrder.Remove(oldest)
+		delete(m.certs, oldest.Value.(*mitmCertificate).host)
+	}
+
+	return cert, nil
+}
+
+func (m *mitm) applyHeaderPolicy(header http.Header) {
+	for _, name := range m.removeHeaders {
+		header.Del(name)
+	}
+	for _, h := range m.setHeaders {
+		header.Set(h[0], h[1])
+	}
+}
+
+// intercept terminates client tls connection with our own certificate and forwards http requests to remote.
+// If connection is not tls, or host must not be intercepted, traffic will be proxied as is.
+func (m *mitm) intercept(config *models.Config, client string, conn net.Conn, remote net.Conn, hostname string, usage *quotaUsage) error {
+	timeoutDuration := time.Duration(config.Server.Timeout) * time.Second
+
+	conn.SetReadDeadline(time.Now().Add(timeoutDuration))
+	serverName, isTLS, conn := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	// Destination of CONNECT decides, server name from client may only repeat it. Only for ip
+	// destinations it can't be compared, then certificate is issued for it, if it's intercepted too.
+	if !isTLS || !m.matchHost(hostname) {
+		go proxyChannel(config, conn, remote, usage)
+		proxyChannel(config, remote, conn, usage)
+		return nil
+	}
+
+	defer conn.Close()
+	defer remote.Close()
+
+	if len(serverName) == 0 {
+		serverName = hostname
+	} else if len(hostname) > 0 && net.ParseIP(hostname) == nil &&
+		!strings.EqualFold(strings.TrimSuffix(serverName, "."), strings.TrimSuffix(hostname, ".")) {
+		return fmt.Errorf("mitm client sent server name %s for connection to %s", serverName, hostname)
+	}
+	if len(serverName) == 0 {
+		return fmt.Errorf("mitm client sent no server name for connection to %s", remote.RemoteAddr().String())
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.certificate(serverName)
+		},
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+	tlsConn.SetDeadline(time.Now().Add(timeoutDuration))
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("mitm handshake with client failed: %s", err)
+	}
+
+	upstream := tls.Client(remote, &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+	upstream.SetDeadline(time.Now().Add(timeoutDuration))
+	if err := upstream.Handshake(); err != nil {
+		tlsConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return fmt.Errorf("mitm handshake with %s failed: %s", serverName, err)
+	}
+
+	log.Infof("%s tls connection to %s intercepted", client, serverName)
+
+	clientReader := bufio.NewReader(tlsConn)
+	upstreamReader := bufio.NewReader(upstream)
+	for {
+		tlsConn.SetDeadline(time.Now().Add(timeoutDuration))
+		request, err := http.ReadRequest(clientReader)
+		if err != nil {
+			return nil
+		}
+
+		m.applyHeaderPolicy(request.Header)
+		if m.logHeaders {
+			log.Infof("%s mitm request headers %s: %v", client, serverName, request.Header)
+		}
+
+		if usage != nil {
+			request.Body = &quotaReader{ReadCloser: request.Body, usage: usage}
+		}
+
+		upstream.SetDeadline(time.Now().Add(timeoutDuration))
+		if err = request.Write(upstream); err != nil {
+			return err
+		}
+
+		response, err := http.ReadResponse(upstreamReader, request)
+		if err != nil {
+			tlsConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return err
+		}
+
+		log.Infof("%s mitm %s https://%s%s %d", client, request.Method, request.Host, request.URL.RequestURI(), response.StatusCode)
+
+		if usage != nil {
+			response.Body = &quotaReader{ReadCloser: response.Body, usage: usage}
+		}
+
+		err = response.Write(tlsConn)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if response.StatusCode == http.StatusSwitchingProtocols {
+			// Websockets and other upgrades are proxied without looking inside.
+			tlsConn.SetDeadline(time.Time{})
+			upstream.SetDeadline(time.Time{})
+
+			go proxyChannel(config, &bufferedConn{Conn: tlsConn, reader: clientReader}, upstream, usage)
+			proxyChannel(config, &bufferedConn{Conn: upstream, reader: upstreamReader}, tlsConn, usage)
+			return nil
+		}
+
+		if request.Close || response.Close {
+			return nil
+		}
+	}
+}
+
+func newMITM(config *models.MitmConfig) (*mitm, error) {
+	keypair, err := tls.LoadX509KeyPair(config.CACert, config.CAKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(keypair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("mitm certificate %s is not a CA", config.CACert)
+	}
+	caKey, ok := keypair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("mitm CA key type not supported")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mitm{
+		ca:    ca,
+		caKey: caKey,
+		key:   key,
+
+		certs:      map[string]*list.Element{},
+		certsOrder: list.New(),
+		certsMutex: &sync.Mutex{},
+
+		users:   map[string]bool{},
+		ports:   map[int]bool{},
+		domains: config.Domain,
+		bypass:  config.Bypass,
+
+		removeHeaders: config.RemoveHeader,
+		logHeaders:    config.LogHeaders,
+	}
+
+	for _, user := range config.User {
+		m.users[user] = true
+	}
+
+	if len(config.Port) == 0 {
+		m.ports[443] = true
+	}
+	for _, port := range config.Port {
+		m.ports[port] = true
+	}
+
+	for _, header := range config.SetHeader {
+		t := strings.SplitN(header, ":", 2)
+		if len(t) != 2 {
+			return nil, fmt.Errorf("mitm header \"%s\" must be in form \"Name: value\"", header)
+		}
+		m.setHeaders = append(m.setHeaders, [2]string{strings.TrimSpace(t[0]), strings.TrimSpace(t[1])})
+	}
+
+	return m, nil
+}
@@ -0,0 +1,499 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Multiplexing protocol between virgild instances. Every frame has header:
+// version (1 byte), command (1 byte), payload length (2 bytes), stream id (4 bytes).
+const (
+	muxVersion    = 0x01
+	muxHeaderSize = 8
+
+	muxCmdAuth = 0x00
+	muxCmdSYN  = 0x01
+	muxCmdACK  = 0x02
+	muxCmdPSH  = 0x03
+	muxCmdFIN  = 0x04
+	muxCmdUPD  = 0x05
+	muxCmdNOP  = 0x06
+
+	muxMaxData = 0x8000
+	// Every stream starts with this window, receiver returns it back with UPD after data is read.
+	muxWindow = 256 * 1024
+	// Peer can't have more streams in one session.
+	muxMaxStreams = 1024
+
+	muxKeepalive = 30 * time.Second
+)
+
+func writeMuxFrame(w io.Writer, cmd byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = cmd
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	copy(frame[muxHeaderSize:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readMuxFrame(reader *bufio.Reader) (byte, uint32, []byte, error) {
+	header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, nil, err
+	}
+	if header[0] != muxVersion {
+		return 0, 0, nil, fmt.Errorf("unsupported mux version %d", header[0])
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header[1], binary.BigEndian.Uint32(header[4:]), payload, nil
+}
+
+// muxSession carries many streams over one connection. Streams are opened only by relay client.
+type muxSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// If set, session is closed when nothing comes from peer for this time.
+	idle time.Duration
+
+	streams      map[uint32]*muxStream
+	streamsMutex *sync.Mutex
+	nextID       uint32
+
+	writeMutex *sync.Mutex
+
+	// onOpen is started in new goroutine for every stream, opened by peer.
+	onOpen func(stream *muxStream, target string)
+
+	die     chan struct{}
+	dieOnce *sync.Once
+}
+
+func newMuxSession(conn net.Conn, reader *bufio.Reader, onOpen func(stream *muxStream, target string)) *muxSession {
+	return &muxSession{
+		conn:         conn,
+		reader:       reader,
+		streams:      map[uint32]*muxStream{},
+		streamsMutex: &sync.Mutex{},
+		writeMutex:   &sync.Mutex{},
+		onOpen:       onOpen,
+		die:          make(chan struct{}),
+		dieOnce:      &sync.Once{},
+	}
+}
+
+func (m *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+
+	return writeMuxFrame(m.conn, cmd, id, payload)
+}
+
+// serve reads frames from peer until connection is closed.
+func (m *muxSession) serve() error {
+	defer m.Close()
+
+	for {
+		if m.idle > 0 {
+			m.conn.SetReadDeadline(time.Now().Add(m.idle))
+		}
+
+		cmd, id, payload, err := readMuxFrame(m.reader)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case muxCmdSYN:
+			if m.onOpen == nil {
+				m.writeFrame(muxCmdFIN, id, []byte("streams can't be opened by server"))
+				continue
+			}
+
+			if m.stream(id) != nil {
+				return fmt.Errorf("mux stream %d is already open", id)
+			}
+			if m.streamsCount() >= muxMaxStreams {
+				m.writeFrame(muxCmdFIN, id, []byte("too many streams"))
+				continue
+			}
+
+			stream := m.newStream(id)
+			go m.onOpen(stream, string(payload))
+		case muxCmdACK:
+			if stream := m.stream(id); stream != nil {
+				notify(stream.established)
+			}
+		case muxCmdPSH:
+			if stream := m.stream(id); stream != nil {
+				if err := stream.push(payload); err != nil {
+					return err
+				}
+			}
+		case muxCmdFIN:
+			if stream := m.stream(id); stream != nil {
+				stream.remoteClose(string(payload))
+			}
+		case muxCmdUPD:
+			if len(payload) != 4 {
+				return fmt.Errorf("wrong mux window update")
+			}
+			if stream := m.stream(id); stream != nil {
+				stream.addWindow(int64(binary.BigEndian.Uint32(payload)))
+			}
+		case muxCmdNOP:
+		default:
+			return fmt.Errorf("unknown mux command %d", cmd)
+		}
+	}
+}
+
+// keepalive sends empty frames, so peer and NATs on the way know, that session is alive.
+func (m *muxSession) keepalive() {
+	ticker := time.NewTicker(muxKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.writeFrame(muxCmdNOP, 0, nil); err != nil {
+				m.Close()
+				return
+			}
+		case <-m.die:
+			return
+		}
+	}
+}
+
+// open asks peer to connect stream to target (host:port) and waits for result.
+func (m *muxSession) open(target string, timeout time.Duration) (*muxStream, error) {
+	m.streamsMutex.Lock()
+	m.nextID++
+	id := m.nextID
+	m.streamsMutex.Unlock()
+
+	stream := m.newStream(id)
+	if err := m.writeFrame(muxCmdSYN, id, []byte(target)); err != nil {
+		m.removeStream(id)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-stream.established:
+	case <-m.die:
+		return nil, fmt.Errorf("mux session closed")
+	case <-timer.C:
+		stream.Close()
+		return nil, fmt.Errorf("mux stream open timeout")
+	}
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.finished {
+		return nil, fmt.Errorf("%s", stream.reason)
+	}
+
+	return stream, nil
+}
+
+func (m *muxSession) newStream(id uint32) *muxStream {
+	stream := &muxStream{
+		id:          id,
+		session:     m,
+		sendWindow:  muxWindow,
+		mutex:       &sync.Mutex{},
+		readEvent:   make(chan struct{}, 1),
+		writeEvent:  make(chan struct{}, 1),
+		established: make(chan struct{}, 1),
+	}
+
+	m.streamsMutex.Lock()
+	m.streams[id] = stream
+	m.streamsMutex.Unlock()
+
+	return stream
+}
+
+func (m *muxSession) stream(id uint32) *muxStream {
+	m.streamsMutex.Lock()
+	defer m.streamsMutex.Unlock()
+
+	return m.streams[id]
+}
+
+func (m *muxSession) streamsCount() int {
+	m.streamsMutex.Lock()
+	defer m.streamsMutex.Unlock()
+
+	return len(m.streams)
+}
+
+func (m *muxSession) removeStream(id uint32) {
+	m.streamsMutex.Lock()
+	delete(m.streams, id)
+	m.streamsMutex.Unlock()
+}
+
+func (m *muxSession) isClosed() bool {
+	select {
+	case <-m.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *muxSession) Close() error {
+	m.dieOnce.Do(func() {
+		close(m.die)
+	})
+
+	return m.conn.Close()
+}
+
+func notify(event chan struct{}) {
+	select {
+	case event <- struct{}{}:
+	default:
+	}
+}
+
+// muxStream is net.Conn on top of one stream of session. Closing stream closes it in both directions.
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	mutex  *sync.Mutex
+	buffer bytes.Buffer
+	// How many bytes we can send, before peer reads them.
+	sendWindow int64
+
+	readEvent   chan struct{}
+	writeEvent  chan struct{}
+	established chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	finished bool
+	reason   string
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mutex.Lock()
+		if st.buffer.Len() > 0 {
+			n, _ := st.buffer.Read(p)
+			st.mutex.Unlock()
+
+			update := make([]byte, 4)
+			binary.BigEndian.PutUint32(update, uint32(n))
+			st.session.writeFrame(muxCmdUPD, st.id, update)
+
+			return n, nil
+		}
+		if st.finished {
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mutex.Unlock()
+
+		if err := st.wait(st.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mutex.Lock()
+		if st.finished {
+			st.mutex.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.sendWindow <= 0 {
+			deadline := st.writeDeadline
+			st.mutex.Unlock()
+
+			if err := st.wait(st.writeEvent, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		size := len(p)
+		if size > muxMaxData {
+			size = muxMaxData
+		}
+		if int64(size) > st.sendWindow {
+			size = int(st.sendWindow)
+		}
+		st.sendWindow -= int64(size)
+		st.mutex.Unlock()
+
+		if err := st.session.writeFrame(muxCmdPSH, st.id, p[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+	}
+
+	return written, nil
+}
+
+func (st *muxStream) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-event:
+		return nil
+	case <-st.session.die:
+		return io.ErrClosedPipe
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// push buffers data from peer. Peer mustn't send more than window, so it's protocol error.
+func (st *muxStream) push(data []byte) error {
+	st.mutex.Lock()
+	if st.buffer.Len()+len(data) > muxWindow {
+		st.mutex.Unlock()
+		return fmt.Errorf("mux stream %d window exceeded", st.id)
+	}
+	st.buffer.Write(data)
+	st.mutex.Unlock()
+
+	notify(st.readEvent)
+	return nil
+}
+
+func (st *muxStream) addWindow(n int64) {
+	st.mutex.Lock()
+	st.sendWindow += n
+	st.mutex.Unlock()
+
+	notify(st.writeEvent)
+}
+
+// remoteClose finishes stream after FIN from peer, reason is set when peer wasn't able to connect.
+func (st *muxStream) remoteClose(reason string) {
+	st.mutex.Lock()
+	st.finished = true
+	st.reason = reason
+	st.mutex.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.readEvent)
+	notify(st.writeEvent)
+	notify(st.established)
+}
+
+// reject tells peer, why stream can't be established.
+func (st *muxStream) reject(err error) {
+	st.mutex.Lock()
+	st.finished = true
+	st.mutex.Unlock()
+
+	st.session.removeStream(st.id)
+	st.session.writeFrame(muxCmdFIN, st.id, []byte(err.Error()))
+}
+
+func (st *muxStream) Close() error {
+	st.mutex.Lock()
+	if st.finished {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.finished = true
+	st.mutex.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.readEvent)
+	notify(st.writeEvent)
+
+	return st.session.writeFrame(muxCmdFIN, st.id, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.mutex.Unlock()
+
+	notify(st.readEvent)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.writeDeadline = t
+	st.mutex.Unlock()
+
+	notify(st.writeEvent)
+	return nil
+}
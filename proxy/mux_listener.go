@@ -0,0 +1,217 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// muxListener accepts sessions from relay clients (other virgild instances).
+type muxListener struct {
+	config    *models.MuxConfig
+	listener  net.Listener
+	tlsConfig *tls.Config
+}
+
+func newMuxListener(config *models.MuxConfig) (*muxListener, error) {
+	m := &muxListener{config: config}
+
+	if len(config.PublicKey) > 0 && len(config.PrivateKey) > 0 {
+		keypair, err := tls.LoadX509KeyPair(config.PublicKey, config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		m.tlsConfig = &tls.Config{Certificates: []tls.Certificate{keypair}, MinVersion: tls.VersionTLS12}
+	}
+
+	var err error
+	if m.listener, err = net.Listen("tcp", config.Bind); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *muxListener) serve(s *Server) {
+	for s.work {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if s.work {
+				log.Errorln("(mux)", err)
+			}
+			continue
+		}
+
+		go handleMux(s, m, conn)
+	}
+}
+
+func (m *muxListener) Close() error {
+	return m.listener.Close()
+}
+
+func handleMux(s *Server, m *muxListener, conn net.Conn) {
+	conn, err := acceptProxyProtocol(s, conn)
+	if err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "proxy protocol error:", err)
+		conn.Close()
+		return
+	}
+	if m.tlsConfig != nil {
+		conn = tls.Server(conn, m.tlsConfig)
+	}
+	defer conn.Close()
+
+	sess := s.sessions.add("mux", conn)
+	defer s.sessions.remove(sess)
+	sess.setProtocol("mux")
+	conn = sess.conn
+
+	client := conn.RemoteAddr().String()
+
+	conn.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+	reader := bufio.NewReader(conn)
+	user, err := muxAuth(s, conn, reader)
+	if err != nil {
+		log.Errorln("client:", client, "auth error:", err)
+		s.stats.authFailed()
+		return
+	}
+
+	if err = checkSubnetsRules(s, user, conn); err != nil {
+		log.Errorln("client:", client, "security error:", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	sess.setUser(user)
+
+	if err = checkSchedule(s, user, "mux"); err != nil {
+		log.Errorln("client:", client, "schedule error:", err)
+		return
+	}
+
+	log.Infof("%s mux session started", client)
+
+	session := newMuxSession(conn, reader, func(stream *muxStream, target string) {
+		handleMuxStream(s, sess, user, client, stream, target)
+	})
+	session.idle = 3 * muxKeepalive
+	err = session.serve()
+
+	log.Infof("%s mux session closed (%s)", client, err)
+}
+
+// muxAuth checks credentials from first frame of session: username and password, prefixed by lengths.
+func muxAuth(s *Server, conn net.Conn, reader *bufio.Reader) (*models.User, error) {
+	cmd, _, payload, err := readMuxFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	if cmd != muxCmdAuth {
+		return nil, fmt.Errorf("mux session must start with auth")
+	}
+
+	if len(payload) < 1 || len(payload) < 2+int(payload[0]) {
+		return nil, fmt.Errorf("wrong mux auth request")
+	}
+	usernameLength := int(payload[0])
+	if len(payload) != 2+usernameLength+int(payload[1+usernameLength]) {
+		return nil, fmt.Errorf("wrong mux auth request")
+	}
+	username := string(payload[1 : 1+usernameLength])
+	password := string(payload[2+usernameLength:])
+
+	if len(username) == 0 && s.config.Server.AllowAnonymous {
+		return nil, writeMuxFrame(conn, muxCmdAuth, 0, []byte{0x00})
+	}
+
+	if user, ok := checkPassword(s, s.authMethods, username, password); ok {
+		if err = checkUserProtocol(user, "mux"); err != nil {
+			writeMuxFrame(conn, muxCmdAuth, 0, []byte{0x01})
+			return nil, err
+		}
+		return user, writeMuxFrame(conn, muxCmdAuth, 0, []byte{0x00})
+	}
+
+	writeMuxFrame(conn, muxCmdAuth, 0, []byte{0x01})
+	return nil, fmt.Errorf("relay client with username: \"%s\" don't exists in our db", username)
+}
+
+func handleMuxStream(s *Server, sess *session, user *models.User, client string, stream *muxStream, target string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		stream.reject(err)
+		log.Errorln("client:", client, "request error:", err)
+		return
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 0xFFFF {
+		stream.reject(fmt.Errorf("wrong port"))
+		log.Errorln("client:", client, "request error: wrong port", port)
+		return
+	}
+
+	if err = checkUserCommand(user, "connect"); err != nil {
+		stream.reject(err)
+		log.Errorln("client:", client, "auth error:", err)
+		return
+	}
+
+	// Session can live long, so quota is checked for every stream.
+	if err = checkUserQuota(s, user); err != nil {
+		stream.reject(err)
+		log.Errorln("client:", client, "quota error:", err)
+		return
+	}
+
+	log.Infof("%s connecting to %s:%d", client, host, p)
+	sess.setDestination(net.JoinHostPort(host, port))
+
+	remote, err := connectHostname(s, user, host, uint16(p))
+	if err != nil {
+		stream.reject(err)
+		log.Errorln("client:", client, "error:", err)
+		return
+	}
+
+	if err = stream.session.writeFrame(muxCmdACK, stream.id, nil); err != nil {
+		remote.Close()
+		stream.Close()
+		return
+	}
+
+	if err = proxyConnection(s, user, client, stream, remote, host, uint16(p)); err != nil {
+		log.Errorln("client:", client, "error:", err)
+	}
+}
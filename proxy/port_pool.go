@@ -0,0 +1,181 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// How many times we will try to find port, that not used by another process.
+	portPoolListenAttempts = 8
+	// Ports, used by another process, will not be touched at least this time.
+	portPoolBusyQuarantine = 30 * time.Second
+)
+
+type PortLease struct {
+	Port  int
+	Owner string
+	Since time.Time
+}
+
+type portPool struct {
+	name       string
+	start      int
+	end        int
+	quarantine time.Duration
+	perOwner   int
+
+	mutex       *sync.Mutex
+	leases      map[int]*PortLease
+	quarantined map[int]time.Time
+	random      *rand.Rand
+}
+
+func (p *portPool) Get(owner string) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.perOwner > 0 {
+		count := 0
+		for _, lease := range p.leases {
+			if lease.Owner == owner {
+				count++
+			}
+		}
+		if count >= p.perOwner {
+			return 0, fmt.Errorf("can't assign new %s port for %s: quota of %d ports exceeded", p.name, owner, p.perOwner)
+		}
+	}
+
+	now := time.Now()
+	free := []int{}
+	for i := p.start; i <= p.end; i++ {
+		if _, used := p.leases[i]; used {
+			continue
+		}
+		if until, ok := p.quarantined[i]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(p.quarantined, i)
+		}
+
+		free = append(free, i)
+	}
+
+	if len(free) == 0 {
+		return 0, fmt.Errorf("can't assign new %s port: all ports already in use or quarantined", p.name)
+	}
+
+	port := free[p.random.Intn(len(free))]
+	p.leases[port] = &PortLease{Port: port, Owner: owner, Since: now}
+
+	return port, nil
+}
+
+func (p *portPool) Free(port int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.leases[port]; !ok {
+		return
+	}
+
+	delete(p.leases, port)
+	if p.quarantine > 0 {
+		p.quarantined[port] = time.Now().Add(p.quarantine)
+	}
+}
+
+// Listen gets new port and calls listen with it. If port is already used by
+// someone else in OS, it will be quarantined and we will try another one.
+func (p *portPool) Listen(owner string, listen func(port int) error) (int, error) {
+	var lastErr error
+	for i := 0; i < portPoolListenAttempts; i++ {
+		port, err := p.Get(owner)
+		if err != nil {
+			if lastErr != nil {
+				return 0, lastErr
+			}
+			return 0, err
+		}
+
+		err = listen(port)
+		if err == nil {
+			return port, nil
+		}
+
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			p.Free(port)
+			return 0, err
+		}
+
+		p.mutex.Lock()
+		delete(p.leases, port)
+		quarantine := portPoolBusyQuarantine
+		if p.quarantine > quarantine {
+			quarantine = p.quarantine
+		}
+		p.quarantined[port] = time.Now().Add(quarantine)
+		p.mutex.Unlock()
+
+		lastErr = err
+	}
+
+	return 0, lastErr
+}
+
+func (p *portPool) Leases() []PortLease {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	leases := make([]PortLease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Port < leases[j].Port })
+
+	return leases
+}
+
+func newPortPool(name string, start, end int, quarantine time.Duration, perOwner int) *portPool {
+	return &portPool{
+		name:       name,
+		start:      start,
+		end:        end,
+		quarantine: quarantine,
+		perOwner:   perOwner,
+
+		mutex:       &sync.Mutex{},
+		leases:      map[int]*PortLease{},
+		quarantined: map[int]time.Time{},
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
@@ -0,0 +1,219 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyProtocolV1MaxLength = 107
+
+// proxyProtocolConn is connection from load balancer, where remote address is taken from PROXY header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// acceptProxyProtocol reads PROXY header (v1 or v2), if connection came from trusted source.
+// Connections without header are accepted as is.
+func acceptProxyProtocol(s *Server, conn net.Conn) (net.Conn, error) {
+	if s.proxyProtocolSubnets.Empty() {
+		return conn, nil
+	}
+	if _, trusted := s.proxyProtocolSubnets.Contains(conn.RemoteAddr().(*net.TCPAddr).IP); !trusted {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil && len(signature) == 0 {
+		return nil, err
+	}
+
+	var remote net.Addr
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		remote, err = readProxyProtocolV2(reader)
+	} else if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		remote, err = readProxyProtocolV1(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("proxy protocol v1 header is too long")
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol v1 header is malformed")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("proxy protocol v1 header has wrong source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 0x02 {
+		return nil, fmt.Errorf("proxy protocol v2 header has wrong version")
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command is used by load balancer itself (health checks), so real address is kept.
+	if header[12]&0x0F == 0x00 {
+		return nil, nil
+	}
+	if header[12]&0x0F != 0x01 {
+		return nil, fmt.Errorf("proxy protocol v2 header has unknown command")
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("proxy protocol v2 header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("proxy protocol v2 header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+
+	// Other families (udp, unix sockets) aren't interesting for us.
+	return nil, nil
+}
+
+// buildProxyProtocolHeader creates PROXY header, describing connection from client to remote.
+func buildProxyProtocolHeader(version string, client *net.TCPAddr, remote *net.TCPAddr) []byte {
+	clientIP, remoteIP := client.IP.To4(), remote.IP.To4()
+	ipv4 := clientIP != nil && remoteIP != nil
+	if !ipv4 {
+		clientIP, remoteIP = client.IP.To16(), remote.IP.To16()
+	}
+
+	if version == "v1" {
+		family := "TCP4"
+		if !ipv4 {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, clientIP.String(), remoteIP.String(), client.Port, remote.Port))
+	}
+
+	header := bytes.NewBuffer(nil)
+	header.Write(proxyProtocolV2Signature)
+	header.WriteByte(0x21)
+	if ipv4 {
+		header.WriteByte(0x11)
+		binary.Write(header, binary.BigEndian, uint16(12))
+	} else {
+		header.WriteByte(0x21)
+		binary.Write(header, binary.BigEndian, uint16(36))
+	}
+	header.Write(clientIP)
+	header.Write(remoteIP)
+	binary.Write(header, binary.BigEndian, uint16(client.Port))
+	binary.Write(header, binary.BigEndian, uint16(remote.Port))
+
+	return header.Bytes()
+}
+
+// sendProxyProtocol writes PROXY header to remote, if its address is in configured subnets.
+func sendProxyProtocol(s *Server, conn net.Conn, remote net.Conn) error {
+	if s.proxyProtocolSendSubnets.Empty() {
+		return nil
+	}
+
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	remoteAddr, ok := remote.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if _, contains := s.proxyProtocolSendSubnets.Contains(remoteAddr.IP); !contains {
+		return nil
+	}
+
+	_, err := remote.Write(buildProxyProtocolHeader(s.config.ProxyProtocol.Send, client, remoteAddr))
+	return err
+}
@@ -0,0 +1,264 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaCounter is traffic of user in current day and month, it's stored in quota file.
+type quotaCounter struct {
+	Day        int64     `json:"day"`
+	Month      int64     `json:"month"`
+	DayStart   time.Time `json:"day_start"`
+	MonthStart time.Time `json:"month_start"`
+}
+
+// quotaTracker counts traffic of users with quotas and saves counters periodically.
+type quotaTracker struct {
+	config   *models.QuotaConfig
+	location *time.Location
+
+	counters map[string]*quotaCounter
+	mutex    *sync.Mutex
+	dirty    bool
+
+	done chan struct{}
+}
+
+// quotaUsage is traffic of one user, shared by all his connections.
+type quotaUsage struct {
+	tracker *quotaTracker
+	user    *models.User
+	counter *quotaCounter
+}
+
+func newQuotaTracker(config *models.QuotaConfig) (*quotaTracker, error) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &quotaTracker{
+		config:   config,
+		location: location,
+		counters: map[string]*quotaCounter{},
+		mutex:    &sync.Mutex{},
+		done:     make(chan struct{}),
+	}
+
+	if len(config.Path) > 0 {
+		data, err := ioutil.ReadFile(config.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err = json.Unmarshal(data, &t.counters); err != nil {
+				return nil, fmt.Errorf("quota file %s: %s", config.Path, err)
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// usage returns traffic counter of user, nil if user has no quota.
+func (t *quotaTracker) usage(user *models.User) *quotaUsage {
+	if t == nil || user == nil || (user.QuotaDay <= 0 && user.QuotaMonth <= 0) {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counter, ok := t.counters[user.Name]
+	if !ok {
+		counter = &quotaCounter{}
+		t.counters[user.Name] = counter
+	}
+
+	return &quotaUsage{tracker: t, user: user, counter: counter}
+}
+
+// periodStarts returns start of current day and start of current month, that begins on reset day.
+func (t *quotaTracker) periodStarts(now time.Time) (time.Time, time.Time) {
+	now = now.In(t.location)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, t.location)
+	month := time.Date(now.Year(), now.Month(), t.config.ResetDay, 0, 0, 0, 0, t.location)
+	if now.Before(month) {
+		month = month.AddDate(0, -1, 0)
+	}
+
+	return day, month
+}
+
+// reset starts new periods for counter, if old ones ended. Mutex must be locked.
+func (t *quotaTracker) reset(counter *quotaCounter) {
+	day, month := t.periodStarts(time.Now())
+	if !counter.DayStart.Equal(day) {
+		counter.Day = 0
+		counter.DayStart = day
+		t.dirty = true
+	}
+	if !counter.MonthStart.Equal(month) {
+		counter.Month = 0
+		counter.MonthStart = month
+		t.dirty = true
+	}
+}
+
+func (t *quotaTracker) save() error {
+	t.mutex.Lock()
+	if !t.dirty {
+		t.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(t.counters)
+	t.dirty = false
+	t.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// File is replaced at once, so it's never half written.
+	tmp := t.config.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, t.config.Path)
+}
+
+func (t *quotaTracker) serve() {
+	if len(t.config.Path) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(t.config.SaveInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.save(); err != nil {
+				log.Errorln("(quota)", err)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *quotaTracker) Close() error {
+	close(t.done)
+
+	if len(t.config.Path) == 0 {
+		return nil
+	}
+
+	return t.save()
+}
+
+// exceeded returns error, if user spent his quota. Mutex must be locked.
+func (u *quotaUsage) exceeded() error {
+	if u.user.QuotaDay > 0 && u.counter.Day >= u.user.QuotaDay {
+		return fmt.Errorf("%w: %d of %d bytes per day used", errQuotaExceeded, u.counter.Day, u.user.QuotaDay)
+	}
+	if u.user.QuotaMonth > 0 && u.counter.Month >= u.user.QuotaMonth {
+		return fmt.Errorf("%w: %d of %d bytes per month used", errQuotaExceeded, u.counter.Month, u.user.QuotaMonth)
+	}
+
+	return nil
+}
+
+func (u *quotaUsage) check() error {
+	u.tracker.mutex.Lock()
+	defer u.tracker.mutex.Unlock()
+
+	u.tracker.reset(u.counter)
+	return u.exceeded()
+}
+
+// add counts n bytes of traffic and returns error, when quota is spent.
+func (u *quotaUsage) add(n int) error {
+	u.tracker.mutex.Lock()
+	defer u.tracker.mutex.Unlock()
+
+	u.tracker.reset(u.counter)
+	u.counter.Day += int64(n)
+	u.counter.Month += int64(n)
+	u.tracker.dirty = true
+
+	return u.exceeded()
+}
+
+// checkUserQuota is called at the beginning of every session of user.
+func checkUserQuota(s *Server, user *models.User) error {
+	if usage := s.quota.usage(user); usage != nil {
+		return usage.check()
+	}
+
+	return nil
+}
+
+// errorStage returns "quota" for exceeded quota, so such failures are easy to find in logs.
+func errorStage(err error, stage string) string {
+	if errors.Is(err, errQuotaExceeded) {
+		return "quota error:"
+	}
+	if len(stage) == 0 {
+		return "error:"
+	}
+
+	return stage + " error:"
+}
+
+// quotaReader counts traffic of http bodies.
+type quotaReader struct {
+	io.ReadCloser
+	usage *quotaUsage
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if quotaErr := r.usage.add(n); quotaErr != nil {
+			return n, quotaErr
+		}
+	}
+
+	return n, err
+}
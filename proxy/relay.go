@@ -0,0 +1,169 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// relay sends all outgoing connections of server to central virgild through one mux session.
+type relay struct {
+	config    *models.RelayConfig
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	session *muxSession
+	mutex   *sync.Mutex
+}
+
+func newRelay(config *models.RelayConfig, timeout time.Duration) (*relay, error) {
+	r := &relay{config: config, timeout: timeout, mutex: &sync.Mutex{}}
+
+	if !config.Insecure {
+		r.tlsConfig = &tls.Config{ServerName: config.ServerName, MinVersion: tls.VersionTLS12}
+		if len(r.tlsConfig.ServerName) == 0 {
+			host, _, err := net.SplitHostPort(config.Address)
+			if err != nil {
+				return nil, err
+			}
+			r.tlsConfig.ServerName = host
+		}
+
+		if len(config.CACert) > 0 {
+			data, err := ioutil.ReadFile(config.CACert)
+			if err != nil {
+				return nil, err
+			}
+			r.tlsConfig.RootCAs = x509.NewCertPool()
+			if !r.tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// connect starts new session with central server.
+func (r *relay) connect() (*muxSession, error) {
+	conn, err := net.DialTimeout("tcp", r.config.Address, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if r.tlsConfig != nil {
+		conn = tls.Client(conn, r.tlsConfig)
+	}
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if len(r.config.Username) > 0xFF || len(r.config.Password) > 0xFF {
+		conn.Close()
+		return nil, fmt.Errorf("relay username and password must be shorter than 256 bytes")
+	}
+	payload := []byte{byte(len(r.config.Username))}
+	payload = append(payload, r.config.Username...)
+	payload = append(payload, byte(len(r.config.Password)))
+	payload = append(payload, r.config.Password...)
+
+	if err = writeMuxFrame(conn, muxCmdAuth, 0, payload); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	cmd, _, answer, err := readMuxFrame(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cmd != muxCmdAuth || len(answer) != 1 || answer[0] != 0x00 {
+		conn.Close()
+		return nil, fmt.Errorf("relay server rejected our credentials")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	session := newMuxSession(conn, reader, nil)
+	go func() {
+		err := session.serve()
+		log.Warnln("(relay) session with", r.config.Address, "closed:", err)
+	}()
+	go session.keepalive()
+
+	log.Infoln("(relay) session with", r.config.Address, "started")
+
+	return session, nil
+}
+
+// getSession returns current session, reconnecting if it's closed.
+func (r *relay) getSession() (*muxSession, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.session == nil || r.session.isClosed() {
+		session, err := r.connect()
+		if err != nil {
+			return nil, fmt.Errorf("relay connection failed: %s", err)
+		}
+		r.session = session
+	}
+
+	return r.session, nil
+}
+
+func (r *relay) dial(host string, port uint16) (net.Conn, error) {
+	session, err := r.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := session.open(net.JoinHostPort(host, strconv.Itoa(int(port))), r.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (r *relay) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.session != nil {
+		return r.session.Close()
+	}
+
+	return nil
+}
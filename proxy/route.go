@@ -0,0 +1,148 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strings"
+
+	"virgild/models"
+)
+
+// splitUsername separates real account name from parameters, e.g. "alice-session-abc-pool-de".
+// Parameters start from the first known key, every key must be followed by value.
+func splitUsername(s *Server, username string) (string, map[string]string, error) {
+	config := &s.config.UsernameParams
+	if len(config.Key) == 0 {
+		return username, nil, nil
+	}
+
+	known := map[string]bool{}
+	for _, key := range config.Key {
+		known[key] = true
+	}
+
+	t := strings.Split(username, config.Separator)
+	start := 1
+	for start < len(t) && !known[t[start]] {
+		start++
+	}
+	if start == len(t) {
+		return username, nil, nil
+	}
+
+	if (len(t)-start)%2 != 0 {
+		return "", nil, fmt.Errorf("username parameter \"%s\" without value", t[len(t)-1])
+	}
+
+	params := map[string]string{}
+	for i := start; i < len(t); i += 2 {
+		if !known[t[i]] {
+			return "", nil, fmt.Errorf("unknown username parameter \"%s\"", t[i])
+		}
+		params[t[i]] = t[i+1]
+	}
+
+	if pool, ok := params["pool"]; ok {
+		if _, ok = s.config.Pool[pool]; !ok {
+			return "", nil, fmt.Errorf("unknown pool \"%s\"", pool)
+		}
+	}
+	if route, ok := params["route"]; ok {
+		if _, ok = s.config.Upstream[route]; !ok {
+			return "", nil, fmt.Errorf("unknown route \"%s\"", route)
+		}
+	}
+
+	return strings.Join(t[:start], config.Separator), params, nil
+}
+
+// checkUserParams checks, that authenticated user is allowed to use route and pool from his username.
+func checkUserParams(s *Server, user *models.User) error {
+	if pool := user.Param("pool"); len(pool) > 0 {
+		if config, ok := s.config.Pool[pool]; !ok || !user.AllowsPool(pool, config.User, config.Group) {
+			return fmt.Errorf("user %s isn't allowed to use pool %s", user.Name, pool)
+		}
+	}
+	if route := user.Param("route"); len(route) > 0 {
+		if config, ok := s.config.Upstream[route]; !ok || !user.AllowsRoute(route, config.User, config.Group) {
+			return fmt.Errorf("user %s isn't allowed to use route %s", user.Name, route)
+		}
+	}
+
+	return nil
+}
+
+// userUpstream returns upstream proxy, selected by user with "route" parameter.
+func userUpstream(s *Server, user *models.User) *models.UpstreamConfig {
+	if route := user.Param("route"); len(route) > 0 {
+		return s.config.Upstream[route]
+	}
+
+	return nil
+}
+
+// poolAddr selects local address for outgoing connection from pool, selected by user. Users with
+// the same session parameter always get the same address.
+func poolAddr(s *Server, user *models.User, ip net.IP) (*net.TCPAddr, error) {
+	name := user.Param("pool")
+	if len(name) == 0 {
+		return nil, nil
+	}
+
+	ipv4 := ip.To4() != nil
+	var ips []net.IP
+	for _, address := range s.config.Pool[name].IPs {
+		if (address.To4() != nil) == ipv4 {
+			ips = append(ips, address)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("pool \"%s\" has no addresses for %s", name, ip.String())
+	}
+
+	if session := user.Param("session"); len(session) > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(user.Name + "\x00" + session))
+		return &net.TCPAddr{IP: ips[hash.Sum32()%uint32(len(ips))]}, nil
+	}
+
+	return &net.TCPAddr{IP: ips[rand.Intn(len(ips))]}, nil
+}
+
+func dialDirect(s *Server, user *models.User, ip net.IP, port uint16) (net.Conn, error) {
+	local, err := poolAddr(s, user, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := net.DialTCP("tcp", local, &net.TCPAddr{IP: ip, Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -25,11 +25,16 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"virgild/models"
 )
 
 func checkSubnetsRules(s *Server, user *models.User, conn net.Conn) error {
+	return checkClientSubnetsRules(s, user, conn.RemoteAddr().(*net.TCPAddr).IP)
+}
+
+func checkClientSubnetsRules(s *Server, user *models.User, ip net.IP) error {
 	if s.allowedSubnets.Empty() && s.blockedSubnets.Empty() {
 		return nil
 	}
@@ -37,7 +42,6 @@ func checkSubnetsRules(s *Server, user *models.User, conn net.Conn) error {
 		return nil
 	}
 
-	ip := conn.RemoteAddr().(*net.TCPAddr).IP
 	if !s.allowedSubnets.Empty() {
 		if _, contains := s.allowedSubnets.Contains(ip); !contains {
 			return fmt.Errorf("blocked, not from allowed subnets")
@@ -54,6 +58,15 @@ func checkSubnetsRules(s *Server, user *models.User, conn net.Conn) error {
 }
 
 func checkRemoteSubnetsRules(s *Server, user *models.User, ip net.IP) error {
+	// Private destinations are denied for everyone, even for authenticated users.
+	if err := checkRemotePrivateRules(s, ip); err != nil {
+		return err
+	}
+
+	if err := checkUserACL(s, user, ip); err != nil {
+		return err
+	}
+
 	if s.config.Subnets.UserWillIgnore && user != nil {
 		return nil
 	}
@@ -66,3 +79,88 @@ func checkRemoteSubnetsRules(s *Server, user *models.User, ip net.IP) error {
 
 	return nil
 }
+
+func checkRemotePrivateRules(s *Server, ip net.IP) error {
+	if s.privateRemoteSubnets.Empty() {
+		return nil
+	}
+
+	if subnet, contains := s.privateRemoteSubnets.Contains(ip); contains {
+		if _, allowed := s.allowedPrivateRemoteSubnets.Contains(ip); !allowed {
+			return fmt.Errorf("blocked remote addr %s, from private subnet %s", ip.String(), subnet.String())
+		}
+	}
+
+	return nil
+}
+
+// checkUserACL checks destination by ACLs of user: it must be allowed by one of them and not denied by any.
+func checkUserACL(s *Server, user *models.User, ip net.IP) error {
+	if user == nil || len(user.ACL) == 0 {
+		return nil
+	}
+
+	s.policyMutex.RLock()
+	defer s.policyMutex.RUnlock()
+
+	allowed := false
+	for _, name := range user.ACL {
+		acl, ok := s.config.ACL[name]
+		if !ok {
+			continue
+		}
+
+		if subnet, denied := acl.DenySubnets.Contains(ip); denied {
+			return fmt.Errorf("blocked remote addr %s, from subnet %s denied by acl %s", ip.String(), subnet.String(), name)
+		}
+		if _, contains := acl.AllowSubnets.Contains(ip); contains || acl.AllowSubnets.Empty() {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return fmt.Errorf("blocked remote addr %s, not allowed by acl of user %s", ip.String(), user.Name)
+	}
+
+	return nil
+}
+
+func checkUserProtocol(user *models.User, protocol string) error {
+	if !user.AllowsProtocol(protocol) {
+		return fmt.Errorf("user %s isn't allowed to use %s", user.Name, protocol)
+	}
+
+	return nil
+}
+
+func checkUserCommand(user *models.User, command string) error {
+	if !user.AllowsCommand(command) {
+		return fmt.Errorf("user %s isn't allowed to use %s command", user.Name, command)
+	}
+
+	return nil
+}
+
+// checkSchedule checks, that now is inside of all schedules, attached to user, his groups or listener.
+func checkSchedule(s *Server, user *models.User, listener string) error {
+	s.policyMutex.RLock()
+	defer s.policyMutex.RUnlock()
+
+	now := time.Now()
+	for name, schedule := range s.config.Schedule {
+		if schedule.AppliesTo(name, user, listener) && !schedule.Allows(now) {
+			return fmt.Errorf("access outside of schedule %s", name)
+		}
+	}
+
+	// Schedule of user may be missed in config, he must not get unlimited access then.
+	if user != nil {
+		for _, name := range user.Schedules {
+			if _, ok := s.config.Schedule[name]; !ok {
+				return fmt.Errorf("user %s has unknown schedule %s", user.Name, name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -24,51 +24,169 @@ package proxy
 
 import (
 	"crypto/tls"
-	"fmt"
 	"net"
+	"net/http"
 	"sync"
+	"text/template"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 
 	"virgild/models"
 )
 
 type Server struct {
-	listener net.Listener
-	tls      bool
-	work     bool
+	listener  net.Listener
+	tls       bool
+	tlsConfig *tls.Config
+	work      bool
 
-	tcpPorts      map[int]bool
-	tcpPortsMutex *sync.Mutex
-	udpPorts      map[int]bool
-	udpPortsMutex *sync.Mutex
+	tcpPorts *portPool
+	udpPorts *portPool
 
-	config      *models.Config
-	authMethods []models.AuthMethod
+	tcpBinds      []*tcpBind
+	tcpBindsMutex *sync.Mutex
+
+	httpTransports      map[string]*http.Transport
+	httpTransportsMutex *sync.Mutex
+
+	limiters      map[string]*userLimiters
+	limitersMutex *sync.Mutex
+
+	quota    *quotaTracker
+	sessions *sessionRegistry
+	admin    *adminListener
+	stats    *statsCollector
+
+	// Protects acls and schedules in config, they are replaced by reload.
+	policyMutex *sync.RWMutex
+
+	lockedUsers      map[string]bool
+	lockedUsersMutex *sync.Mutex
+
+	mitm        *mitm
+	pacTemplate *template.Template
+	transparent *transparent
+	forwards    []*forward
+	shadowsocks *shadowsocks
+	websocket   *websocket
+	mux         *muxListener
+	relay       *relay
+	ssh         *sshListener
+
+	config          *models.Config
+	authMethods     []models.AuthMethod
+	httpAuthMethods []models.HTTPAuthMethod
 
 	allowedSubnets       *models.SubnetChecker
 	blockedSubnets       *models.SubnetChecker
 	allowedRemoteSubnets *models.SubnetChecker
+
+	privateRemoteSubnets        *models.SubnetChecker
+	allowedPrivateRemoteSubnets *models.SubnetChecker
+
+	proxyProtocolSubnets     *models.SubnetChecker
+	proxyProtocolSendSubnets *models.SubnetChecker
 }
 
 func (s *Server) Init() error {
-	if s.tls {
-		keypair, err := tls.LoadX509KeyPair(s.config.Server.PublicKey, s.config.Server.PrivateKey)
-		if err != nil {
+	if s.config.Server.AllowHTTP {
+		var err error
+		if s.pacTemplate, err = newPACTemplate(s.config.Pac.Template); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if s.quota, err = newQuotaTracker(&s.config.Quota); err != nil {
+		return err
+	}
+
+	if s.config.Mitm.Enable {
+		var err error
+		if s.mitm, err = newMITM(&s.config.Mitm); err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.Server.TransparentBind) > 0 {
+		var err error
+		if s.transparent, err = newTransparent(s.config.Server.TransparentBind, s.config.Server.TransparentMode); err != nil {
 			return err
 		}
+	}
 
-		tlsConfig := &tls.Config{Certificates: []tls.Certificate{keypair}, MinVersion: tls.VersionTLS12}
-		s.listener, err = tls.Listen("tcp", s.config.Server.Bind, tlsConfig)
+	for name, config := range s.config.Forward {
+		f, err := newForward(name, config)
 		if err != nil {
 			return err
 		}
-	} else {
+		s.forwards = append(s.forwards, f)
+	}
+
+	if len(s.config.Shadowsocks.Bind) > 0 {
 		var err error
-		s.listener, err = net.Listen("tcp", s.config.Server.Bind)
+		if s.shadowsocks, err = newShadowsocks(&s.config.Shadowsocks); err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.WebSocket.Bind) > 0 {
+		var err error
+		if s.websocket, err = newWebSocket(&s.config.WebSocket); err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.Mux.Bind) > 0 {
+		var err error
+		if s.mux, err = newMuxListener(&s.config.Mux); err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.Relay.Address) > 0 {
+		var err error
+		if s.relay, err = newRelay(&s.config.Relay, time.Duration(s.config.Server.Timeout)*time.Second); err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.Admin.Bind) > 0 {
+		if s.admin, err = newAdminListener(&s.config.Admin); err != nil {
+			return err
+		}
+
+		// Statistics are needed only for dashboard of admin api.
+		s.stats = newStatsCollector()
+		s.sessions.stats = s.stats
+		log.AddHook(s.stats)
+	}
+
+	if len(s.config.SSH.Bind) > 0 {
+		var err error
+		if s.ssh, err = newSSHListener(&s.config.SSH, s.config.Server.AllowAnonymous, s.authMethods); err != nil {
+			return err
+		}
+	}
+
+	// Tls is started by handle, because PROXY header comes before it.
+	if s.tls {
+		keypair, err := tls.LoadX509KeyPair(s.config.Server.PublicKey, s.config.Server.PrivateKey)
 		if err != nil {
 			return err
 		}
+
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{keypair}, MinVersion: tls.VersionTLS12}
+		if s.config.Server.AllowHTTP && s.config.Server.HTTP2 {
+			s.tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		}
+	}
+
+	s.listener, err = net.Listen("tcp", s.config.Server.Bind)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -77,6 +195,45 @@ func (s *Server) Init() error {
 func (s *Server) Close() error {
 	s.work = false
 
+	s.tcpBindsMutex.Lock()
+	for _, bind := range s.tcpBinds {
+		bind.listener.Close()
+	}
+	s.tcpBindsMutex.Unlock()
+
+	s.closeHTTPTransports()
+
+	if s.transparent != nil {
+		s.transparent.Close()
+	}
+	for _, f := range s.forwards {
+		f.Close()
+	}
+	if s.shadowsocks != nil {
+		s.shadowsocks.Close()
+	}
+	if s.websocket != nil {
+		s.websocket.Close()
+	}
+	if s.mux != nil {
+		s.mux.Close()
+	}
+	if s.relay != nil {
+		s.relay.Close()
+	}
+	if s.ssh != nil {
+		s.ssh.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+		s.stats.Close()
+	}
+	if s.quota != nil {
+		if err := s.quota.Close(); err != nil {
+			log.Errorln("(quota)", err)
+		}
+	}
+
 	if s.listener != nil {
 		err := s.listener.Close()
 		if err != nil {
@@ -95,26 +252,84 @@ func (s *Server) Start() error {
 	for _, authMethod := range s.authMethods {
 		authMethods += authMethod.GetName() + " "
 	}
+	for _, authMethod := range s.httpAuthMethods {
+		authMethods += authMethod.GetName() + " "
+	}
 
 	log.Infof("Starting new proxy server. Configuration:\n"+
 		"Bind:\t\t\t\t%s\n"+
 		"TLS:\t\t\t\t%t\n"+
 		"Auth methods:\t\t\t%s\n"+
 		"HTTP allowed:\t\t%t\n"+
+		"HTTP/2 allowed:\t\t%t\n"+
 		"TCP bind allowed:\t\t%t\n"+
 		"UDP association allowed:\t%t\n"+
 		"Filter by allowed subnets:\t%t\n"+
 		"Filter by blocked subnets:\t%t\n"+
-		"Filter by remote subnets:\t%t\n",
+		"Filter by remote subnets:\t%t\n"+
+		"Deny private remote subnets:\t%t\n"+
+		"TLS interception:\t\t%t\n"+
+		"PROXY protocol trusted:\t%t\n"+
+		"Transparent proxy:\t\t%s\n"+
+		"Forwarding rules:\t\t%d\n"+
+		"Shadowsocks:\t\t\t%s\n"+
+		"WebSocket:\t\t\t%s\n"+
+		"Mux listener:\t\t\t%s\n"+
+		"Relay to:\t\t\t%s\n"+
+		"SSH:\t\t\t\t%s\n"+
+		"Admin api:\t\t\t%s\n",
 		s.config.Server.Bind,
 		s.tls,
 		authMethods,
 		s.config.Server.AllowHTTP,
+		s.tls && s.config.Server.AllowHTTP && s.config.Server.HTTP2,
 		s.config.Server.AllowTCPBind,
 		s.config.Server.AllowUDPAssociation,
 		!s.allowedSubnets.Empty(),
 		!s.blockedSubnets.Empty(),
-		!s.allowedRemoteSubnets.Empty())
+		!s.allowedRemoteSubnets.Empty(),
+		!s.privateRemoteSubnets.Empty(),
+		s.mitm != nil,
+		!s.proxyProtocolSubnets.Empty(),
+		s.config.Server.TransparentBind,
+		len(s.forwards),
+		s.config.Shadowsocks.Bind,
+		s.config.WebSocket.Bind,
+		s.config.Mux.Bind,
+		s.config.Relay.Address,
+		s.config.SSH.Bind,
+		s.config.Admin.Bind)
+
+	go s.quota.serve()
+	go s.watchSchedules()
+	if s.admin != nil {
+		go s.stats.serve(s.sessions)
+		go s.admin.serve(s)
+	}
+	if s.transparent != nil {
+		go s.transparent.serveTCP(s)
+		if s.transparent.udp != nil {
+			go s.transparent.serveUDP(s)
+		}
+	}
+	for _, f := range s.forwards {
+		go f.serve(s)
+	}
+	if s.shadowsocks != nil {
+		go s.shadowsocks.serve(s)
+		if s.shadowsocks.udp != nil {
+			go s.shadowsocks.serveUDP(s)
+		}
+	}
+	if s.websocket != nil {
+		go s.websocket.serve(s)
+	}
+	if s.mux != nil {
+		go s.mux.serve(s)
+	}
+	if s.ssh != nil {
+		go s.ssh.serve(s)
+	}
 
 	for s.work {
 		conn, err := s.listener.Accept()
@@ -131,72 +346,62 @@ func (s *Server) Start() error {
 	return nil
 }
 
-func (s *Server) GetTCPPort() (int, error) {
-	s.tcpPortsMutex.Lock()
-	defer s.tcpPortsMutex.Unlock()
-
-	for i := s.config.Server.TCPBindPortsStart; i <= s.config.Server.TCPBindPortsEnd; i++ {
-		used := s.tcpPorts[i]
-		if !used {
-			s.tcpPorts[i] = true
-			return i, nil
-		}
-	}
-
-	return 0, fmt.Errorf("can't assign new tcp port for bind: all ports already in use")
+func (s *Server) TCPPortLeases() []PortLease {
+	return s.tcpPorts.Leases()
 }
 
-func (s *Server) FreeTCPPort(port int) {
-	s.tcpPortsMutex.Lock()
-	defer s.tcpPortsMutex.Unlock()
-
-	s.tcpPorts[port] = false
-}
-
-func (s *Server) GetUDPPort() (int, error) {
-	s.udpPortsMutex.Lock()
-	defer s.udpPortsMutex.Unlock()
-
-	for i := s.config.Server.UDPAssociationPortsStart; i <= s.config.Server.UDPAssociationPortsEnd; i++ {
-		used := s.udpPorts[i]
-		if !used {
-			s.udpPorts[i] = true
-			return i, nil
-		}
-	}
-
-	return 0, fmt.Errorf("can't assign new udp port for bind: all ports already in use")
-}
-
-func (s *Server) FreeUDPPort(port int) {
-	s.udpPortsMutex.Lock()
-	defer s.udpPortsMutex.Unlock()
-
-	s.udpPorts[port] = false
+func (s *Server) UDPPortLeases() []PortLease {
+	return s.udpPorts.Leases()
 }
 
 func NewServer(config *models.Config,
 	tls bool,
 	authMethods []models.AuthMethod,
+	httpAuthMethods []models.HTTPAuthMethod,
 	allowedSubnets *models.SubnetChecker,
 	blockedSubnets *models.SubnetChecker,
-	allowedRemoteSubnets *models.SubnetChecker) (*Server, error) {
+	allowedRemoteSubnets *models.SubnetChecker,
+	privateRemoteSubnets *models.SubnetChecker,
+	allowedPrivateRemoteSubnets *models.SubnetChecker,
+	proxyProtocolSubnets *models.SubnetChecker,
+	proxyProtocolSendSubnets *models.SubnetChecker) (*Server, error) {
 
 	server := &Server{
 		tls:  tls,
 		work: true,
 
-		tcpPorts:      map[int]bool{},
-		tcpPortsMutex: &sync.Mutex{},
-		udpPorts:      map[int]bool{},
-		udpPortsMutex: &sync.Mutex{},
+		tcpPorts: newPortPool("tcp", config.Server.TCPBindPortsStart, config.Server.TCPBindPortsEnd,
+			time.Duration(config.Server.PortsQuarantine)*time.Second, config.Server.PortsPerUser),
+		udpPorts: newPortPool("udp", config.Server.UDPAssociationPortsStart, config.Server.UDPAssociationPortsEnd,
+			time.Duration(config.Server.PortsQuarantine)*time.Second, config.Server.PortsPerUser),
+
+		tcpBindsMutex: &sync.Mutex{},
 
-		config:      config,
-		authMethods: authMethods,
+		httpTransports:      map[string]*http.Transport{},
+		httpTransportsMutex: &sync.Mutex{},
+
+		limiters:      map[string]*userLimiters{},
+		limitersMutex: &sync.Mutex{},
+
+		sessions:    newSessionRegistry(),
+		policyMutex: &sync.RWMutex{},
+
+		lockedUsers:      map[string]bool{},
+		lockedUsersMutex: &sync.Mutex{},
+
+		config:          config,
+		authMethods:     authMethods,
+		httpAuthMethods: httpAuthMethods,
 
 		allowedSubnets:       allowedSubnets,
 		blockedSubnets:       blockedSubnets,
 		allowedRemoteSubnets: allowedRemoteSubnets,
+
+		privateRemoteSubnets:        privateRemoteSubnets,
+		allowedPrivateRemoteSubnets: allowedPrivateRemoteSubnets,
+
+		proxyProtocolSubnets:     proxyProtocolSubnets,
+		proxyProtocolSendSubnets: proxyProtocolSendSubnets,
 	}
 
 	return server, nil
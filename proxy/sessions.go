@@ -0,0 +1,197 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+const scheduleCheckInterval = 30 * time.Second
+
+// session is client connection, registered until it's served. User, protocol and
+// destination are set, when they become known.
+type session struct {
+	id       uint64
+	listener string
+	client   string
+	conn     net.Conn
+	started  time.Time
+
+	// Bytes from client and to client, they are changed atomically.
+	uploaded   int64
+	downloaded int64
+
+	mutex       *sync.Mutex
+	user        *models.User
+	protocol    string
+	destination string
+
+	// Traffic, that is already counted by statistics, and closing flag. They are protected
+	// by mutex of statsCollector.
+	statsReported [2]int64
+	statsClosed   bool
+}
+
+// sessionConn counts traffic of session.
+type sessionConn struct {
+	net.Conn
+	sess *session
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.sess.uploaded, int64(n))
+	return n, err
+}
+
+func (c *sessionConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.sess.downloaded, int64(n))
+	return n, err
+}
+
+func (sess *session) setUser(user *models.User) {
+	sess.mutex.Lock()
+	sess.user = user
+	sess.mutex.Unlock()
+}
+
+func (sess *session) setProtocol(protocol string) {
+	sess.mutex.Lock()
+	sess.protocol = protocol
+	sess.mutex.Unlock()
+}
+
+func (sess *session) setDestination(destination string) {
+	sess.mutex.Lock()
+	sess.destination = destination
+	sess.mutex.Unlock()
+}
+
+func (sess *session) getUser() *models.User {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	return sess.user
+}
+
+type sessionRegistry struct {
+	sessions map[uint64]*session
+	nextID   uint64
+	mutex    *sync.Mutex
+
+	// Optional statistics for dashboard.
+	stats *statsCollector
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: map[uint64]*session{},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// add registers connection, it must be used through sess.conn to count traffic.
+// Closing conn must stop the session.
+func (r *sessionRegistry) add(listener string, conn net.Conn) *session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nextID++
+	sess := &session{
+		id:       r.nextID,
+		listener: listener,
+		client:   conn.RemoteAddr().String(),
+		started:  time.Now(),
+		mutex:    &sync.Mutex{},
+	}
+	sess.conn = &sessionConn{Conn: conn, sess: sess}
+	r.sessions[sess.id] = sess
+	r.stats.sessionOpened()
+
+	return sess
+}
+
+func (r *sessionRegistry) remove(sess *session) {
+	r.mutex.Lock()
+	delete(r.sessions, sess.id)
+	r.mutex.Unlock()
+
+	r.stats.sessionClosed(sess)
+}
+
+func (r *sessionRegistry) get(id uint64) *session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.sessions[id]
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		list = append(list, sess)
+	}
+
+	return list
+}
+
+// closeUser closes all sessions of user and returns their number.
+func (r *sessionRegistry) closeUser(name string) int {
+	closed := 0
+	for _, sess := range r.list() {
+		if user := sess.getUser(); user != nil && user.Name == name {
+			sess.conn.Close()
+			closed++
+		}
+	}
+
+	return closed
+}
+
+// watchSchedules closes sessions, that outlive windows of their schedules.
+func (s *Server) watchSchedules() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for s.work {
+		<-ticker.C
+
+		for _, sess := range s.sessions.list() {
+			if err := checkSchedule(s, sess.getUser(), sess.listener); err != nil {
+				log.Errorln("client:", sess.client, "schedule error:", err)
+				sess.conn.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,491 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+const ssMaxPayload = 0x3FFF
+const ss2022MaxPayload = 0xFFFF
+
+type shadowsocks struct {
+	method *ssMethod
+	// Pre-shared key. With users in 2022 edition it's identity key of server.
+	key   []byte
+	users []*ssUser
+
+	listener net.Listener
+	udp      *net.UDPConn
+
+	salts   *ssSaltCache
+	replays *ssReplayFilter
+
+	udpSessions      map[string]*ssUDPSession
+	udpSessionsMutex *sync.Mutex
+}
+
+// ssTarget is destination, requested by client, with data sent together with request.
+type ssTarget struct {
+	ip       net.IP
+	hostname string
+	port     uint16
+	payload  []byte
+}
+
+func newShadowsocks(config *models.ShadowsocksConfig) (*shadowsocks, error) {
+	method, ok := ssMethods[config.Method]
+	if !ok {
+		return nil, fmt.Errorf("shadowsocks method \"%s\" not supported", config.Method)
+	}
+
+	ss := &shadowsocks{
+		method:           method,
+		salts:            &ssSaltCache{salts: map[string]time.Time{}, mutex: &sync.Mutex{}},
+		replays:          &ssReplayFilter{windows: map[string]*ssReplayWindow{}, mutex: &sync.Mutex{}},
+		udpSessions:      map[string]*ssUDPSession{},
+		udpSessionsMutex: &sync.Mutex{},
+	}
+
+	if len(config.Password) > 0 {
+		var err error
+		if ss.key, err = method.key(config.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, line := range config.User {
+		t := strings.SplitN(line, ":", 2)
+		if len(t) != 2 || len(t[0]) == 0 {
+			return nil, fmt.Errorf("shadowsocks user must be in \"name:password\" format")
+		}
+
+		user, err := newSsUser(method, t[0], t[1])
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks user %s: %s", t[0], err)
+		}
+		ss.users = append(ss.users, user)
+	}
+
+	if ss.key == nil && len(ss.users) == 0 {
+		return nil, fmt.Errorf("shadowsocks needs password or users")
+	}
+	if method.is2022 && len(ss.users) > 0 {
+		// Users are identified by encrypted identity header, which is defined only for aes.
+		if method.chacha {
+			return nil, fmt.Errorf("shadowsocks 2022 with chacha20 doesn't support multiple users")
+		}
+		if ss.key == nil {
+			return nil, fmt.Errorf("shadowsocks 2022 with users needs server password (identity key)")
+		}
+	}
+
+	var err error
+	if ss.listener, err = net.Listen("tcp", config.Bind); err != nil {
+		return nil, err
+	}
+
+	if config.UDP {
+		addr, err := net.ResolveUDPAddr("udp", config.Bind)
+		if err != nil {
+			ss.listener.Close()
+			return nil, err
+		}
+		if ss.udp, err = net.ListenUDP("udp", addr); err != nil {
+			ss.listener.Close()
+			return nil, err
+		}
+	}
+
+	return ss, nil
+}
+
+func (ss *shadowsocks) Close() {
+	ss.listener.Close()
+	if ss.udp != nil {
+		ss.udp.Close()
+	}
+}
+
+// load returns user for security rules, nil means shared password without user name.
+func (u *ssUser) load(s *Server) (*models.User, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	user, err := loadUser(s, u.name)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, checkUserProtocol(user, "shadowsocks")
+}
+
+func (ss *shadowsocks) findUserByHash(hash []byte) *ssUser {
+	for _, user := range ss.users {
+		if bytes.Equal(user.hash, hash) {
+			return user
+		}
+	}
+	return nil
+}
+
+func parseSsAddress(data []byte) (*ssTarget, error) {
+	// Address has the same format, as in socks5 udp packet header.
+	packet, err := parseUDPPacket(append([]byte{0x00, 0x00, 0x00}, data...))
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: %s", err)
+	}
+
+	return &ssTarget{ip: packet.ip, hostname: packet.hostname, port: packet.port, payload: packet.data}, nil
+}
+
+func readSsAddress(reader io.Reader) (*ssTarget, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	switch header[0] {
+	case 0x01:
+		addrLen = net.IPv4len + 2 - 1
+	case 0x03:
+		addrLen = int(header[1]) + 2
+	case 0x04:
+		addrLen = net.IPv6len + 2 - 1
+	default:
+		return nil, fmt.Errorf("shadowsocks request has unknown address type")
+	}
+
+	data := make([]byte, len(header)+addrLen)
+	copy(data, header)
+	if _, err := io.ReadFull(reader, data[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return parseSsAddress(data)
+}
+
+func (ss *shadowsocks) serve(s *Server) {
+	for s.work {
+		conn, err := ss.listener.Accept()
+		if err != nil {
+			if s.work {
+				log.Errorln("(shadowsocks)", err)
+			}
+			continue
+		}
+
+		go handleShadowsocks(s, ss, conn)
+	}
+}
+
+func handleShadowsocks(s *Server, ss *shadowsocks, conn net.Conn) {
+	defer conn.Close()
+
+	sess := s.sessions.add("shadowsocks", conn)
+	defer s.sessions.remove(sess)
+	sess.setProtocol("shadowsocks")
+	conn = sess.conn
+
+	timeoutDuration := time.Duration(s.config.Server.Timeout) * time.Second
+	conn.SetReadDeadline(time.Now().Add(timeoutDuration))
+
+	client := conn.RemoteAddr().String()
+
+	var sc *ssConn
+	var target *ssTarget
+	var user *ssUser
+	var err error
+	if ss.method.is2022 {
+		sc, target, user, err = ss.accept2022(conn)
+	} else {
+		sc, target, user, err = ss.accept(conn)
+	}
+	if err != nil {
+		log.Errorln("client:", client, "shadowsocks error:", err)
+		// Closing right after bad request would tell active prober, how much data we wanted.
+		io.Copy(ioutil.Discard, conn)
+		return
+	}
+
+	if user != nil {
+		client = fmt.Sprintf("%s(%s)", client, user.name)
+	}
+
+	record, err := user.load(s)
+	if err != nil {
+		log.Errorln("client:", client, "auth error:", err)
+		s.stats.authFailed()
+		return
+	}
+
+	if err = checkSubnetsRules(s, record, conn); err != nil {
+		log.Errorln("client:", client, "security error:", err)
+		return
+	}
+	if err = checkUserCommand(record, "connect"); err != nil {
+		log.Errorln("client:", client, "auth error:", err)
+		return
+	}
+	if err = checkUserQuota(s, record); err != nil {
+		log.Errorln("client:", client, "quota error:", err)
+		return
+	}
+	sess.setUser(record)
+	if len(target.hostname) > 0 {
+		sess.setDestination(net.JoinHostPort(target.hostname, strconv.Itoa(int(target.port))))
+	} else {
+		sess.setDestination(net.JoinHostPort(target.ip.String(), strconv.Itoa(int(target.port))))
+	}
+
+	if err = checkSchedule(s, record, "shadowsocks"); err != nil {
+		log.Errorln("client:", client, "schedule error:", err)
+		return
+	}
+
+	var remote net.Conn
+	if len(target.hostname) > 0 {
+		log.Infof("%s connecting to %s:%d (shadowsocks)", client, target.hostname, target.port)
+		remote, err = connectHostname(s, record, target.hostname, target.port)
+	} else {
+		log.Infof("%s connecting to %s (shadowsocks)", client, net.JoinHostPort(target.ip.String(), fmt.Sprint(target.port)))
+		remote, err = connectIP(s, record, target.ip, target.port)
+	}
+	if err != nil {
+		log.Errorln("client:", client, "error:", err)
+		return
+	}
+
+	if len(target.payload) > 0 {
+		if _, err = remote.Write(target.payload); err != nil {
+			remote.Close()
+			log.Errorln("client:", client, "error:", err)
+			return
+		}
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	if err = proxyConnection(s, record, client, sc, remote, target.hostname, target.port); err != nil {
+		log.Errorln("client:", client, "error:", err)
+	}
+}
+
+// accept reads request of original AEAD shadowsocks. User is found by trying keys one by one.
+func (ss *shadowsocks) accept(conn net.Conn) (*ssConn, *ssTarget, *ssUser, error) {
+	method := ss.method
+
+	salt := make([]byte, method.keySize)
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, nil, nil, err
+	}
+
+	aead, err := method.newAEAD(make([]byte, method.keySize))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	lengthChunk := make([]byte, 2+aead.Overhead())
+	if _, err := io.ReadFull(conn, lengthChunk); err != nil {
+		return nil, nil, nil, err
+	}
+
+	candidates := ss.users
+	if ss.key != nil {
+		candidates = append(append([]*ssUser{}, ss.users...), &ssUser{key: ss.key})
+	}
+
+	var reader *ssStreamReader
+	var user *ssUser
+	for _, candidate := range candidates {
+		aead, err := method.newAEAD(method.subkey(candidate.key, salt))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		nonce := make([]byte, aead.NonceSize())
+		length, err := aead.Open(nil, nonce, lengthChunk, nil)
+		if err != nil {
+			continue
+		}
+		increaseNonce(nonce)
+
+		reader = &ssStreamReader{reader: conn, aead: aead, nonce: nonce, maxPayload: ssMaxPayload}
+		if err = reader.setLength(length); err != nil {
+			return nil, nil, nil, err
+		}
+		if len(candidate.name) > 0 {
+			user = candidate
+		}
+		break
+	}
+	if reader == nil {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request can't be decrypted with any key")
+	}
+
+	if !ss.salts.add(salt) {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request replayed")
+	}
+
+	target, err := readSsAddress(reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	writer, err := ss.newWriter(conn, user, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &ssConn{Conn: conn, reader: reader, writer: writer}, target, user, nil
+}
+
+// accept2022 reads request of shadowsocks 2022 edition: salt, optional identity header,
+// fixed length header and variable length header with address.
+func (ss *shadowsocks) accept2022(conn net.Conn) (*ssConn, *ssTarget, *ssUser, error) {
+	method := ss.method
+
+	salt := make([]byte, method.keySize)
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, nil, nil, err
+	}
+
+	key := ss.key
+	var user *ssUser
+	if len(ss.users) > 0 {
+		identity := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(conn, identity); err != nil {
+			return nil, nil, nil, err
+		}
+
+		block, err := aes.NewCipher(method.identitySubkey(ss.key, salt))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		block.Decrypt(identity, identity)
+
+		if user = ss.findUserByHash(identity); user == nil {
+			return nil, nil, nil, fmt.Errorf("shadowsocks request has unknown user identity")
+		}
+		key = user.key
+	}
+
+	aead, err := method.newAEAD(method.subkey(key, salt))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader := &ssStreamReader{reader: conn, aead: aead, nonce: make([]byte, aead.NonceSize()), length: -1, maxPayload: ss2022MaxPayload}
+
+	fixed, err := reader.open(1 + 8 + 2)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request can't be decrypted")
+	}
+	if fixed[0] != ss2022HeaderTypeRequest {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request has wrong header type")
+	}
+	if err = checkSsTimestamp(binary.BigEndian.Uint64(fixed[1:9])); err != nil {
+		return nil, nil, nil, err
+	}
+	if !ss.salts.add(salt) {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request replayed")
+	}
+
+	variable, err := reader.open(int(binary.BigEndian.Uint16(fixed[9:11])))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	target, err := parseSsAddress(variable)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Address is followed by padding and initial payload.
+	if len(target.payload) < 2 {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request header is too short")
+	}
+	padding := int(binary.BigEndian.Uint16(target.payload[0:2]))
+	if len(target.payload) < 2+padding {
+		return nil, nil, nil, fmt.Errorf("shadowsocks request header is too short")
+	}
+	target.payload = target.payload[2+padding:]
+
+	header := make([]byte, 1+8, 1+8+len(salt))
+	header[0] = ss2022HeaderTypeResponse
+	binary.BigEndian.PutUint64(header[1:9], uint64(time.Now().Unix()))
+	header = append(header, salt...)
+
+	writer, err := ss.newWriter(conn, user, header)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &ssConn{Conn: conn, reader: reader, writer: writer}, target, user, nil
+}
+
+// newWriter creates encryption for our side of connection with new salt.
+func (ss *shadowsocks) newWriter(conn net.Conn, user *ssUser, header []byte) (*ssStreamWriter, error) {
+	key := ss.key
+	if user != nil {
+		key = user.key
+	}
+
+	salt := make([]byte, ss.method.keySize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := ss.method.newAEAD(ss.method.subkey(key, salt))
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &ssStreamWriter{
+		writer:     conn,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		prefix:     salt,
+		header:     header,
+		maxPayload: ssMaxPayload,
+	}
+	if ss.method.is2022 {
+		writer.maxPayload = ss2022MaxPayload
+	}
+
+	return writer, nil
+}
@@ -0,0 +1,257 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+// Clients of shadowsocks 2022 must have clock in sync with us, it protects from replays.
+const ssMaxTimeDifference = 30 * time.Second
+
+const ss2022HeaderTypeRequest = 0x00
+const ss2022HeaderTypeResponse = 0x01
+
+type ssMethod struct {
+	keySize int
+	is2022  bool
+	chacha  bool
+}
+
+var ssMethods = map[string]*ssMethod{
+	"aes-128-gcm":                   {keySize: 16},
+	"aes-256-gcm":                   {keySize: 32},
+	"chacha20-ietf-poly1305":        {keySize: 32, chacha: true},
+	"2022-blake3-aes-128-gcm":       {keySize: 16, is2022: true},
+	"2022-blake3-aes-256-gcm":       {keySize: 32, is2022: true},
+	"2022-blake3-chacha20-poly1305": {keySize: 32, is2022: true, chacha: true},
+}
+
+func (m *ssMethod) newAEAD(key []byte) (cipher.AEAD, error) {
+	if m.chacha {
+		return chacha20poly1305.New(key)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// key returns pre-shared key: 2022 edition uses base64 encoded key, older one derives it from password.
+func (m *ssMethod) key(password string) ([]byte, error) {
+	if !m.is2022 {
+		return evpBytesToKey(password, m.keySize), nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks 2022 key must be base64 encoded: %s", err)
+	}
+	if len(key) != m.keySize {
+		return nil, fmt.Errorf("shadowsocks 2022 key must be %d bytes long", m.keySize)
+	}
+
+	return key, nil
+}
+
+func (m *ssMethod) subkey(key []byte, salt []byte) []byte {
+	subkey := make([]byte, m.keySize)
+	if m.is2022 {
+		material := append(append([]byte{}, key...), salt...)
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", material)
+		return subkey
+	}
+
+	io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey)
+	return subkey
+}
+
+// identitySubkey is used to encrypt user identity in 2022 edition with multiple users.
+func (m *ssMethod) identitySubkey(key []byte, salt []byte) []byte {
+	subkey := make([]byte, len(key))
+	material := append(append([]byte{}, key...), salt...)
+	blake3.DeriveKey(subkey, "shadowsocks 2022 identity subkey", material)
+	return subkey
+}
+
+// evpBytesToKey is OpenSSL EVP_BytesToKey with md5 and without salt, as original shadowsocks uses.
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+
+	return key[:keySize]
+}
+
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func checkSsTimestamp(timestamp uint64) error {
+	difference := time.Since(time.Unix(int64(timestamp), 0))
+	if difference > ssMaxTimeDifference || difference < -ssMaxTimeDifference {
+		return fmt.Errorf("shadowsocks client time differs by %s", difference.Round(time.Second))
+	}
+
+	return nil
+}
+
+type ssUser struct {
+	name string
+	key  []byte
+	// BLAKE3 hash of key, truncated to 16 bytes, identifies user in 2022 edition.
+	hash []byte
+}
+
+func newSsUser(method *ssMethod, name string, password string) (*ssUser, error) {
+	key, err := method.key(password)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := blake3.Sum256(key)
+	return &ssUser{name: name, key: key, hash: hash[:aes.BlockSize]}, nil
+}
+
+// ssSaltCache remembers salts of recent connections, so recorded traffic can't be replayed.
+type ssSaltCache struct {
+	salts   map[string]time.Time
+	cleanup time.Time
+	mutex   *sync.Mutex
+}
+
+func (c *ssSaltCache) add(salt []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.After(c.cleanup) {
+		for salt, expire := range c.salts {
+			if now.After(expire) {
+				delete(c.salts, salt)
+			}
+		}
+		c.cleanup = now.Add(ssMaxTimeDifference)
+	}
+
+	if _, ok := c.salts[string(salt)]; ok {
+		return false
+	}
+	c.salts[string(salt)] = now.Add(2 * ssMaxTimeDifference)
+
+	return true
+}
+
+// Packet ids of shadowsocks 2022 udp sessions are checked by sliding window of this size:
+// reordered packets still pass, replayed and too old ones are dropped.
+const ssReplayWindowSize = 1024
+
+type ssReplayWindow struct {
+	// The biggest packet id, that was seen.
+	last   uint64
+	bitmap [ssReplayWindowSize / 64]uint64
+	expire time.Time
+}
+
+// add returns false, if packet id was already seen or is older than window.
+func (w *ssReplayWindow) add(id uint64) bool {
+	if id > w.last {
+		// Bits of ids after the last one up to the new one are left from older packets, they are cleared.
+		if id-w.last >= ssReplayWindowSize {
+			w.bitmap = [ssReplayWindowSize / 64]uint64{}
+		} else {
+			// Loop is bounded by count, ids near the end of uint64 would overflow.
+			for n := uint64(0); n < id-w.last; n++ {
+				i := w.last + 1 + n
+				w.bitmap[i/64%uint64(len(w.bitmap))] &^= 1 << (i % 64)
+			}
+		}
+		w.last = id
+	} else if w.last-id >= ssReplayWindowSize {
+		return false
+	}
+
+	index, bit := id/64%uint64(len(w.bitmap)), uint64(1)<<(id%64)
+	if w.bitmap[index]&bit != 0 {
+		return false
+	}
+	w.bitmap[index] |= bit
+
+	return true
+}
+
+// ssReplayFilter keeps windows of client sessions longer, than their timestamps are valid,
+// so packets can't be replayed even after relay session is closed by timeout.
+type ssReplayFilter struct {
+	windows map[string]*ssReplayWindow
+	cleanup time.Time
+	mutex   *sync.Mutex
+}
+
+func (f *ssReplayFilter) add(session string, id uint64) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	if now.After(f.cleanup) {
+		for session, window := range f.windows {
+			if now.After(window.expire) {
+				delete(f.windows, session)
+			}
+		}
+		f.cleanup = now.Add(ssMaxTimeDifference)
+	}
+
+	window, ok := f.windows[session]
+	if !ok {
+		window = &ssReplayWindow{}
+		f.windows[session] = window
+	}
+	window.expire = now.Add(2 * ssMaxTimeDifference)
+
+	return window.add(id)
+}
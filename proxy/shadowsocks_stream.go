@@ -0,0 +1,157 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ssStreamReader decrypts stream of chunks: encrypted length, then encrypted payload.
+type ssStreamReader struct {
+	reader io.Reader
+	aead   cipher.AEAD
+	nonce  []byte
+
+	buffer []byte
+	// Length of the next payload chunk, if it's already read, or -1.
+	length int
+	// Longer chunks are not allowed by method (0x3FFF before 2022 edition).
+	maxPayload int
+}
+
+// setLength takes length of the next payload chunk from decrypted length chunk.
+func (r *ssStreamReader) setLength(chunk []byte) error {
+	length := int(chunk[0])<<8 | int(chunk[1])
+	if length > r.maxPayload {
+		return fmt.Errorf("shadowsocks chunk is too long: %d bytes", length)
+	}
+	r.length = length
+
+	return nil
+}
+
+func (r *ssStreamReader) open(size int) ([]byte, error) {
+	data := make([]byte, size+r.aead.Overhead())
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return nil, err
+	}
+
+	plain, err := r.aead.Open(data[:0], r.nonce, data, nil)
+	increaseNonce(r.nonce)
+
+	return plain, err
+}
+
+func (r *ssStreamReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		if r.length < 0 {
+			length, err := r.open(2)
+			if err != nil {
+				return 0, err
+			}
+			if err = r.setLength(length); err != nil {
+				return 0, err
+			}
+		}
+
+		payload, err := r.open(r.length)
+		if err != nil {
+			return 0, err
+		}
+		r.length = -1
+		r.buffer = payload
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+
+	return n, nil
+}
+
+// ssStreamWriter encrypts data the same way, as ssStreamReader decrypts it.
+type ssStreamWriter struct {
+	writer io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+
+	// Salt is sent before the first chunk.
+	prefix []byte
+	// Response header of 2022 edition replaces the first length chunk.
+	header     []byte
+	maxPayload int
+}
+
+func (w *ssStreamWriter) seal(dst []byte, plain []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, plain, nil)
+	increaseNonce(w.nonce)
+
+	return dst
+}
+
+func (w *ssStreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.maxPayload {
+			chunk = p[:w.maxPayload]
+		}
+
+		buffer := w.prefix
+		w.prefix = nil
+
+		length := []byte{byte(len(chunk) >> 8), byte(len(chunk))}
+		if w.header != nil {
+			buffer = w.seal(buffer, append(w.header, length...))
+			w.header = nil
+		} else {
+			buffer = w.seal(buffer, length)
+		}
+		buffer = w.seal(buffer, chunk)
+
+		if _, err := w.writer.Write(buffer); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+type ssConn struct {
+	net.Conn
+	reader *ssStreamReader
+	writer *ssStreamWriter
+}
+
+func (c *ssConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *ssConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
@@ -0,0 +1,438 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ssUDPSession relays packets of one client through udp association with its own relay socket.
+type ssUDPSession struct {
+	association *udpAssociation
+	mutex       *sync.Mutex
+
+	relay      net.PacketConn
+	clientAddr *net.UDPAddr
+	user       *ssUser
+	sess       *session
+
+	// Only for 2022 edition.
+	clientSessionID []byte
+	serverSessionID []byte
+	packetID        uint64
+}
+
+// ssUDPSessionConn stands for udp session in registry of sessions, closing it stops the session.
+// Packets don't go through it, session counts their traffic itself.
+type ssUDPSessionConn struct {
+	net.PacketConn
+	clientAddr net.Addr
+}
+
+func (c *ssUDPSessionConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *ssUDPSessionConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c *ssUDPSessionConn) RemoteAddr() net.Addr {
+	return c.clientAddr
+}
+
+// ssUDPPacket is decrypted client packet.
+type ssUDPPacket struct {
+	user      *ssUser
+	sessionID []byte
+	packetID  uint64
+	// Address and payload, as in socks5 udp packet without RSV and FRAG.
+	data []byte
+}
+
+func (ss *shadowsocks) serveUDP(s *Server) {
+	buffer := make([]byte, 65535)
+	for s.work {
+		n, from, err := ss.udp.ReadFromUDP(buffer)
+		if err != nil {
+			if s.work {
+				log.Errorln("(shadowsocks)", err)
+			}
+			continue
+		}
+
+		var packet *ssUDPPacket
+		if ss.method.is2022 {
+			packet, err = ss.openUDP2022(buffer[:n])
+		} else {
+			packet, err = ss.openUDP(buffer[:n])
+		}
+		if err != nil {
+			log.Debugln("(shadowsocks) udp packet from", from.String(), "dropped:", err)
+			continue
+		}
+
+		if err = ss.clientUDPPacket(s, from, packet); err != nil {
+			log.Debugln("(shadowsocks)", err)
+		}
+	}
+}
+
+func (ss *shadowsocks) openUDP(data []byte) (*ssUDPPacket, error) {
+	method := ss.method
+	if len(data) < method.keySize {
+		return nil, fmt.Errorf("packet is too short")
+	}
+	salt := data[:method.keySize]
+
+	candidates := ss.users
+	if ss.key != nil {
+		candidates = append(append([]*ssUser{}, ss.users...), &ssUser{key: ss.key})
+	}
+
+	for _, candidate := range candidates {
+		aead, err := method.newAEAD(method.subkey(candidate.key, salt))
+		if err != nil {
+			return nil, err
+		}
+
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), data[method.keySize:], nil)
+		if err != nil {
+			continue
+		}
+
+		packet := &ssUDPPacket{data: plain}
+		if len(candidate.name) > 0 {
+			packet.user = candidate
+		}
+		return packet, nil
+	}
+
+	return nil, fmt.Errorf("packet can't be decrypted with any key")
+}
+
+func (ss *shadowsocks) openUDP2022(data []byte) (*ssUDPPacket, error) {
+	method := ss.method
+	packet := &ssUDPPacket{}
+
+	var header, plain []byte
+	if method.chacha {
+		// Whole packet is encrypted by XChaCha20-Poly1305 with random nonce.
+		aead, err := chacha20poly1305.NewX(ss.key)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, fmt.Errorf("packet is too short")
+		}
+
+		plain, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+		if err != nil || len(plain) < 16 {
+			return nil, fmt.Errorf("packet can't be decrypted")
+		}
+		header, plain = plain[:16], plain[16:]
+	} else {
+		// Separate header (session id and packet id) is encrypted by aes with the key itself.
+		if len(data) < aes.BlockSize {
+			return nil, fmt.Errorf("packet is too short")
+		}
+		block, err := aes.NewCipher(ss.key)
+		if err != nil {
+			return nil, err
+		}
+		header = make([]byte, aes.BlockSize)
+		block.Decrypt(header, data[:aes.BlockSize])
+		data = data[aes.BlockSize:]
+
+		key := ss.key
+		if len(ss.users) > 0 {
+			if len(data) < aes.BlockSize {
+				return nil, fmt.Errorf("packet is too short")
+			}
+			identity := make([]byte, aes.BlockSize)
+			block.Decrypt(identity, data[:aes.BlockSize])
+			for i := range identity {
+				identity[i] ^= header[i]
+			}
+			data = data[aes.BlockSize:]
+
+			if packet.user = ss.findUserByHash(identity); packet.user == nil {
+				return nil, fmt.Errorf("packet has unknown user identity")
+			}
+			key = packet.user.key
+		}
+
+		aead, err := method.newAEAD(method.subkey(key, header[:8]))
+		if err != nil {
+			return nil, err
+		}
+		if plain, err = aead.Open(nil, header[4:16], data, nil); err != nil {
+			return nil, fmt.Errorf("packet can't be decrypted")
+		}
+	}
+
+	packet.sessionID = header[:8]
+	packet.packetID = binary.BigEndian.Uint64(header[8:16])
+
+	// Main header: type, timestamp, padding length and padding, then address and payload.
+	if len(plain) < 1+8+2 {
+		return nil, fmt.Errorf("packet header is too short")
+	}
+	if plain[0] != ss2022HeaderTypeRequest {
+		return nil, fmt.Errorf("packet has wrong header type")
+	}
+	if err := checkSsTimestamp(binary.BigEndian.Uint64(plain[1:9])); err != nil {
+		return nil, err
+	}
+	padding := int(binary.BigEndian.Uint16(plain[9:11]))
+	if len(plain) < 11+padding {
+		return nil, fmt.Errorf("packet header is too short")
+	}
+	packet.data = plain[11+padding:]
+
+	return packet, nil
+}
+
+// sealUDP encrypts packet for client, data is address of remote peer and payload.
+func (ss *shadowsocks) sealUDP(session *ssUDPSession, data []byte) ([]byte, error) {
+	method := ss.method
+	key := ss.key
+	if session.user != nil {
+		key = session.user.key
+	}
+
+	if !method.is2022 {
+		salt := make([]byte, method.keySize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		aead, err := method.newAEAD(method.subkey(key, salt))
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), data, nil), nil
+	}
+
+	header := make([]byte, 16)
+	copy(header, session.serverSessionID)
+	binary.BigEndian.PutUint64(header[8:16], session.packetID)
+	session.packetID++
+
+	plain := make([]byte, 1+8, 1+8+8+2+len(data))
+	plain[0] = ss2022HeaderTypeResponse
+	binary.BigEndian.PutUint64(plain[1:9], uint64(time.Now().Unix()))
+	plain = append(plain, session.clientSessionID...)
+	plain = append(plain, 0x00, 0x00)
+	plain = append(plain, data...)
+
+	if method.chacha {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return aead.Seal(nonce, nonce, append(header, plain...), nil), nil
+	}
+
+	aead, err := method.newAEAD(method.subkey(key, session.serverSessionID))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := make([]byte, aes.BlockSize)
+	block.Encrypt(packet, header)
+	return aead.Seal(packet, header[4:16], plain, nil), nil
+}
+
+func (ss *shadowsocks) clientUDPPacket(s *Server, from *net.UDPAddr, packet *ssUDPPacket) error {
+	key := from.String()
+	if packet.sessionID != nil {
+		key = hex.EncodeToString(packet.sessionID)
+	}
+	if packet.user != nil {
+		key = packet.user.name + "/" + key
+	}
+
+	if packet.sessionID != nil && !ss.replays.add(key, packet.packetID) {
+		return fmt.Errorf("udp packet %d of session %s replayed", packet.packetID, key)
+	}
+
+	ss.udpSessionsMutex.Lock()
+	session, ok := ss.udpSessions[key]
+	ss.udpSessionsMutex.Unlock()
+
+	if !ok {
+		var err error
+		if session, err = ss.newUDPSession(s, key, from, packet); err != nil {
+			return err
+		}
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	// Client may change its address (nat rebinding), session id stays the same.
+	session.clientAddr = from
+	session.relay.SetReadDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+	atomic.AddInt64(&session.sess.uploaded, int64(len(packet.data)))
+
+	err := session.association.clientPacket(append([]byte{0x00, 0x00, 0x00}, packet.data...))
+	if errors.Is(err, errQuotaExceeded) {
+		log.Errorln("client:", session.association.client, "quota error:", err)
+		// Replies goroutine stops and removes session, when relay is closed.
+		session.relay.Close()
+	}
+
+	return err
+}
+
+func (ss *shadowsocks) newUDPSession(s *Server, key string, from *net.UDPAddr, packet *ssUDPPacket) (*ssUDPSession, error) {
+	user, err := packet.user.load(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClientSubnetsRules(s, user, from.IP); err != nil {
+		return nil, err
+	}
+	if err := checkUserCommand(user, "udp"); err != nil {
+		return nil, err
+	}
+	if err := checkUserQuota(s, user); err != nil {
+		return nil, err
+	}
+	if err := checkSchedule(s, user, "shadowsocks"); err != nil {
+		return nil, err
+	}
+
+	relay, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	client := from.String()
+	if packet.user != nil {
+		client = fmt.Sprintf("%s(%s)", client, packet.user.name)
+	}
+
+	session := &ssUDPSession{
+		mutex:           &sync.Mutex{},
+		relay:           relay,
+		clientAddr:      from,
+		user:            packet.user,
+		clientSessionID: packet.sessionID,
+	}
+	if ss.method.is2022 {
+		session.serverSessionID = make([]byte, 8)
+		if _, err := rand.Read(session.serverSessionID); err != nil {
+			relay.Close()
+			return nil, err
+		}
+	}
+
+	// Session is registered, so it's closed by schedules, admin api and user lock as tcp sessions.
+	session.sess = s.sessions.add("shadowsocks", &ssUDPSessionConn{PacketConn: relay, clientAddr: from})
+	session.sess.setProtocol("shadowsocks")
+	session.sess.setUser(user)
+
+	session.association = newUDPAssociation(s, user, client, from.IP, relay, nil, 0)
+	session.association.sendToClient = func(data []byte) error {
+		// Skip RSV and FRAG of socks5 udp packet.
+		encrypted, err := ss.sealUDP(session, data[3:])
+		if err != nil {
+			return err
+		}
+		if _, err = ss.udp.WriteToUDP(encrypted, session.clientAddr); err != nil {
+			return err
+		}
+		atomic.AddInt64(&session.sess.downloaded, int64(len(data)-3))
+		return nil
+	}
+
+	log.Infof("%s udp session started (shadowsocks)", client)
+
+	ss.udpSessionsMutex.Lock()
+	ss.udpSessions[key] = session
+	ss.udpSessionsMutex.Unlock()
+
+	go ss.udpSessionReplies(s, key, session)
+
+	return session, nil
+}
+
+// udpSessionReplies relays packets from remote peers, until session is idle for server timeout.
+func (ss *shadowsocks) udpSessionReplies(s *Server, key string, session *ssUDPSession) {
+	defer func() {
+		ss.udpSessionsMutex.Lock()
+		delete(ss.udpSessions, key)
+		ss.udpSessionsMutex.Unlock()
+
+		session.relay.Close()
+		s.sessions.remove(session.sess)
+		session.mutex.Lock()
+		session.association.Close()
+		session.mutex.Unlock()
+	}()
+
+	timeoutDuration := time.Duration(s.config.Server.Timeout) * time.Second
+	buffer := make([]byte, 65535)
+	for {
+		session.relay.SetReadDeadline(time.Now().Add(timeoutDuration))
+		n, addr, err := session.relay.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		session.mutex.Lock()
+		session.association.expireFlows(false)
+		err = session.association.remotePacket(addr.(*net.UDPAddr), buffer[:n])
+		session.mutex.Unlock()
+
+		if errors.Is(err, errQuotaExceeded) {
+			log.Errorln("client:", session.association.client, "quota error:", err)
+			return
+		}
+		if err != nil {
+			log.Debugln("(shadowsocks)", err)
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -39,6 +40,7 @@ type socks4Client struct {
 	server      *Server
 	config      *models.Config
 	conn        net.Conn
+	reader      *bufio.Reader
 	useHostname bool
 
 	command  byte
@@ -46,6 +48,8 @@ type socks4Client struct {
 	ip       net.IP
 	userID   []byte
 	hostname string
+
+	user *models.User
 }
 
 func (s *socks4Client) Read(reader *bufio.Reader) error {
@@ -109,7 +113,12 @@ func (s *socks4Client) AnswerBind(code byte, ip net.IP, port uint16) []byte {
 	binary.Write(&buffer, binary.LittleEndian, answer)
 
 	binary.Write(&buffer, binary.BigEndian, port)
-	binary.Write(&buffer, binary.LittleEndian, ip.To4())
+	if t := ip.To4(); t != nil {
+		binary.Write(&buffer, binary.LittleEndian, t)
+	} else {
+		// Only ipv4 can be sent in socks4, so for ipv6 peers client will get 0.0.0.0.
+		binary.Write(&buffer, binary.LittleEndian, net.IPv4zero.To4())
+	}
 
 	return buffer.Bytes()
 }
@@ -130,6 +139,7 @@ func (s *socks4Client) Validate() error {
 
 func (s *socks4Client) Handshake(reader *bufio.Reader) error {
 	var err error
+	s.reader = reader
 	if err = s.Read(reader); err != nil {
 		return err
 	}
@@ -141,13 +151,138 @@ func (s *socks4Client) Handshake(reader *bufio.Reader) error {
 }
 
 func (s *socks4Client) Auth(reader *bufio.Reader, authMethods []models.AuthMethod) (*models.User, error) {
-	// Socks4 don't support authentication (ident not what we want, huh)
-	if !s.config.Server.AllowAnonymous {
+	userID := string(s.userID)
+	ident := s.config.Server.Socks4Ident && s.identTrusted()
+
+	if len(s.config.Server.Socks4Auth) == 0 && !ident {
+		if !s.config.Server.AllowAnonymous {
+			s.conn.Write(s.Answer(0x5B))
+			return nil, fmt.Errorf("socks4 authentication not configured and anonymous access disabled in config")
+		}
+
+		return nil, nil
+	}
+
+	if len(userID) == 0 && s.config.Server.AllowAnonymous {
+		return nil, nil
+	}
+
+	var user *models.User
+	if len(s.config.Server.Socks4Auth) > 0 {
+		var err error
+		if user, err = s.checkUserID(userID, authMethods); err != nil {
+			s.conn.Write(s.Answer(0x5B))
+			return nil, err
+		}
+	}
+
+	if ident {
+		identUser, err := identLookup(s.conn, time.Duration(s.config.Server.Timeout)*time.Second)
+		if err != nil {
+			s.conn.Write(s.Answer(0x5C))
+			return nil, err
+		}
+
+		// Without other authentication user id is only compared with ident answer, if client sent it.
+		expected := userID
+		if user != nil {
+			expected = user.Name
+		}
+		if len(expected) > 0 && identUser != expected {
+			s.conn.Write(s.Answer(0x5D))
+			return nil, fmt.Errorf("socks4 client sent user id \"%s\", but ident answered \"%s\"", expected, identUser)
+		}
+
+		// Ident answer is chosen by client host, so only names of our users are accepted, others are anonymous.
+		if user == nil {
+			known, err := knownUser(s.server, identUser)
+			if err != nil {
+				s.conn.Write(s.Answer(0x5B))
+				return nil, err
+			}
+
+			if known {
+				if user, err = loadUser(s.server, identUser); err != nil {
+					s.conn.Write(s.Answer(0x5B))
+					return nil, err
+				}
+			} else if !s.config.Server.AllowAnonymous {
+				s.conn.Write(s.Answer(0x5B))
+				return nil, fmt.Errorf("ident answered unknown user \"%s\" and anonymous access disabled in config", identUser)
+			}
+		}
+	}
+
+	if err := checkUserProtocol(user, "socks4"); err != nil {
+		s.conn.Write(s.Answer(0x5B))
+		return nil, err
+	}
+
+	command := "connect"
+	if s.command == 0x02 {
+		command = "bind"
+	}
+	if err := checkUserCommand(user, command); err != nil {
+		s.conn.Write(s.Answer(0x5B))
+		return nil, err
+	}
+	if err := checkUserQuota(s.server, user); err != nil {
 		s.conn.Write(s.Answer(0x5B))
-		return nil, fmt.Errorf("socks4 don't support authentication and anonymous access disabled in config")
+		return nil, err
+	}
+
+	s.user = user
+	return user, nil
+}
+
+// identTrusted checks, that client is in trusted subnets, only such hosts can tell us names of their users.
+func (s *socks4Client) identTrusted() bool {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	_, trusted := s.config.Server.Socks4IdentSubnets.Contains(ip)
+	return trusted
+}
+
+// checkUserID authenticates user by "username:password" or bearer token sent in user id field.
+func (s *socks4Client) checkUserID(userID string, authMethods []models.AuthMethod) (*models.User, error) {
+	switch s.config.Server.Socks4Auth {
+	case "password":
+		t := strings.SplitN(userID, ":", 2)
+		if len(t) != 2 {
+			return nil, fmt.Errorf("socks4 client sent user id without password")
+		}
+
+		if user, ok := checkPassword(s.server, authMethods, t[0], t[1]); ok {
+			return user, nil
+		}
+
+		return nil, fmt.Errorf("socks4 client with username: \"%s\" don't exists in our db or password is wrong", t[0])
+	case "token":
+		for _, method := range s.server.httpAuthMethods {
+			if !strings.EqualFold(method.Scheme(), "Bearer") {
+				continue
+			}
+
+			username, ok, err := method.CheckHTTP("", "", userID)
+			if err != nil {
+				log.Errorln("(auth)", err)
+			}
+			if ok {
+				return loadUser(s.server, username)
+			}
+		}
+
+		return nil, fmt.Errorf("socks4 client sent unknown token")
 	}
 
-	return nil, nil
+	return nil, fmt.Errorf("unknown socks4 authentication %s", s.config.Server.Socks4Auth)
 }
 
 func (s *socks4Client) Request(reader *bufio.Reader) error {
@@ -171,12 +306,12 @@ func (s *socks4Client) Work() error {
 
 		var remote net.Conn
 		if s.useHostname {
-			if remote, err = connectHostname(s.server, nil, s.hostname, s.port); err != nil {
+			if remote, err = connectHostname(s.server, s.user, s.hostname, s.port); err != nil {
 				s.conn.Write(s.Answer(0x5B))
 				return err
 			}
 		} else {
-			if remote, err = connectIP(s.server, nil, s.ip, s.port); err != nil {
+			if remote, err = connectIP(s.server, s.user, s.ip, s.port); err != nil {
 				s.conn.Write(s.Answer(0x5B))
 				return err
 			}
@@ -184,43 +319,37 @@ func (s *socks4Client) Work() error {
 
 		s.conn.Write(s.Answer(0x5A))
 
-		go proxyChannel(s.config, s.conn, remote)
-		proxyChannel(s.config, remote, s.conn)
-
-		return nil
+		conn := &bufferedConn{Conn: s.conn, reader: s.reader}
+		return proxyConnection(s.server, s.user, s.conn.RemoteAddr().String(), conn, remote, s.hostname, s.port)
 	} else if s.command == 0x02 {
 		// TCP BIND
-		if s.config.Server.TCPBindAddrIsHostname {
-			s.conn.Write(s.Answer(0x5B))
-			return fmt.Errorf("socks4 don't support tcp binding on hostname, please, use socks5 or change your config")
-		} else if len(s.config.Server.TCPBindAddrIP) != 4 {
+		// Socks4 answer can contain only ipv4 address, so we need one.
+		addr, err := selectTCPBindAddr(s.server, s.conn, true)
+		if err != nil {
 			s.conn.Write(s.Answer(0x5B))
-			return fmt.Errorf("socks4 don't support tcp binding on ipv6, please, use socks5 or change your config")
+			return err
 		}
+		ip, _ := addr.LookupIPv4()
 
-		port, err := s.server.GetTCPPort()
+		expected, err := lookupBindPeer(s.ip, s.hostname)
 		if err != nil {
 			s.conn.Write(s.Answer(0x5B))
 			return err
 		}
-		defer s.server.FreeTCPPort(port)
 
-		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.Server.TCPBindAddrIP.String(), port))
+		bind, err := s.server.getTCPBind(s.conn, nil, addr)
 		if err != nil {
 			s.conn.Write(s.Answer(0x5B))
 			return err
 		}
-		defer listener.Close()
-
-		tcpListener := listener.(*net.TCPListener)
-		tcpListener.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+		defer s.server.releaseTCPBind(bind)
 
-		log.Infof("%s request tcp bind on %s:%d", s.conn.RemoteAddr().String(), s.config.Server.TCPBindAddrIP.String(), port)
-		s.conn.Write(s.AnswerBind(0x5A, s.config.Server.TCPBindAddrIP, uint16(port)))
+		log.Infof("%s request tcp bind on %s:%d", s.conn.RemoteAddr().String(), ip.String(), bind.port)
+		s.conn.Write(s.AnswerBind(0x5A, ip, uint16(bind.port)))
 
-		remote, err := listener.Accept()
+		remote, err := bind.accept(s.server, s.user, s.conn.RemoteAddr().String(), expected)
 		if err != nil {
-			s.conn.Write(s.AnswerBind(0x5B, s.config.Server.TCPBindAddrIP, uint16(port)))
+			s.conn.Write(s.AnswerBind(0x5B, ip, uint16(bind.port)))
 			return err
 		}
 		defer remote.Close()
@@ -229,8 +358,9 @@ func (s *socks4Client) Work() error {
 		log.Infof("%s get new tcp connection from %s", s.conn.RemoteAddr().String(), remote.RemoteAddr().String())
 		s.conn.Write(s.AnswerBind(0x5A, remoteAddr.IP, uint16(remoteAddr.Port)))
 
-		go proxyChannel(s.config, s.conn, remote)
-		proxyChannel(s.config, remote, s.conn)
+		usage := s.server.quota.usage(s.user)
+		go proxyChannel(s.config, s.conn, remote, usage)
+		proxyChannel(s.config, remote, s.conn, usage)
 
 		return nil
 	}
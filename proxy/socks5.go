@@ -26,9 +26,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
-	"time"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 
@@ -39,6 +40,7 @@ type socks5Client struct {
 	server *Server
 	config *models.Config
 	conn   net.Conn
+	reader *bufio.Reader
 	user   *models.User
 
 	handshake socks5Handshake
@@ -261,6 +263,14 @@ func (s *socks5Request) AnswerBindHostname(version byte, result byte, hostname s
 	return buffer.Bytes()
 }
 
+func (s *socks5Request) AnswerBindAddr(version byte, result byte, addr *models.BindAddr, port uint16) []byte {
+	if addr.IsHostname() {
+		return s.AnswerBindHostname(version, result, addr.Hostname, port)
+	}
+
+	return s.AnswerBindIP(version, result, addr.IP, port)
+}
+
 func (s *socks5Client) Handshake(reader *bufio.Reader) error {
 	var err error
 	if err = s.handshake.Read(reader); err != nil {
@@ -284,23 +294,31 @@ func (s *socks5Client) Auth(reader *bufio.Reader, authMethods []models.AuthMetho
 				return nil, err
 			}
 
-			ok := false
-			for _, method := range authMethods {
-				ok, err = method.Check(s.auth.username, s.auth.password)
-				if err != nil {
-					log.Errorln("(auth)", err)
-				}
-				if ok {
-					s.conn.Write(s.auth.Answer(0x00))
-					s.user = &models.User{Name: s.auth.username}
-					return s.user, nil
-				}
+			username, params, err := splitUsername(s.server, s.auth.username)
+			if err != nil {
+				s.conn.Write(s.auth.Answer(0x01))
+				return nil, err
 			}
 
+			user, ok := checkPassword(s.server, authMethods, username, s.auth.password)
 			if !ok {
 				s.conn.Write(s.auth.Answer(0x01))
-				return nil, fmt.Errorf("socks5 client with username: \"%s\" and password: \"%s\" don't exists in our db", s.auth.username, s.auth.password)
+				return nil, fmt.Errorf("socks5 client with username: \"%s\" don't exists in our db or password is wrong", s.auth.username)
+			}
+			if err = checkUserProtocol(user, "socks5"); err != nil {
+				s.conn.Write(s.auth.Answer(0x01))
+				return nil, err
+			}
+
+			user.Params = params
+			if err = checkUserParams(s.server, user); err != nil {
+				s.conn.Write(s.auth.Answer(0x01))
+				return nil, err
 			}
+
+			s.conn.Write(s.auth.Answer(0x00))
+			s.user = user
+			return s.user, nil
 		}
 	}
 
@@ -313,6 +331,7 @@ func (s *socks5Client) Request(reader *bufio.Reader) error {
 	if err = s.request.Read(reader); err != nil {
 		return err
 	}
+	s.reader = reader
 
 	if s.request.version != 0x05 {
 		return fmt.Errorf("socks5 client send wrong request version")
@@ -329,13 +348,39 @@ func (s *socks5Client) Request(reader *bufio.Reader) error {
 			s.conn.Write(s.request.Answer(0x02))
 			return fmt.Errorf("UDP association disabled in config")
 		}
+	} else if s.request.command == socks5CommandUDPTunnel {
+		if !s.config.Server.AllowUDPOverTCP {
+			s.conn.Write(s.request.Answer(0x07))
+			return fmt.Errorf("UDP over TCP disabled in config")
+		}
 	} else {
 		return fmt.Errorf("socks5 client send unknown command")
 	}
 
+	if err = checkUserCommand(s.user, socks5CommandName(s.request.command)); err != nil {
+		s.conn.Write(s.request.Answer(0x02))
+		return err
+	}
+	if err = checkUserQuota(s.server, s.user); err != nil {
+		s.conn.Write(s.request.Answer(0x02))
+		return err
+	}
+
 	return nil
 }
 
+func socks5CommandName(command byte) string {
+	switch command {
+	case 0x01:
+		return "connect"
+	case 0x02:
+		return "bind"
+	}
+
+	// Udp association and udp over tcp.
+	return "udp"
+}
+
 func (s *socks5Client) Work() error {
 	var client string
 	if s.user != nil {
@@ -371,45 +416,35 @@ func (s *socks5Client) Work() error {
 
 		s.conn.Write(s.request.Answer(0x00))
 
-		go proxyChannel(s.config, s.conn, remote)
-		proxyChannel(s.config, remote, s.conn)
-
-		return nil
+		conn := &bufferedConn{Conn: s.conn, reader: s.reader}
+		return proxyConnection(s.server, s.user, client, conn, remote, s.request.hostname, s.request.port)
 	} else if s.request.command == 0x02 {
 		// TCP BIND
-		port, err := s.server.GetTCPPort()
+		addr, err := selectTCPBindAddr(s.server, s.conn, false)
 		if err != nil {
 			s.conn.Write(s.request.Answer(0x01))
 			return err
 		}
-		defer s.server.FreeTCPPort(port)
 
-		var listener net.Listener
-		if s.config.Server.TCPBindAddrIsHostname {
-			listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.Server.TCPBindAddrHostname, port))
-		} else {
-			listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.Server.TCPBindAddrIP.String(), port))
+		expected, err := lookupBindPeer(s.request.ip, s.request.hostname)
+		if err != nil {
+			s.conn.Write(s.request.Answer(0x04))
+			return err
 		}
+
+		bind, err := s.server.getTCPBind(s.conn, s.user, addr)
 		if err != nil {
 			s.conn.Write(s.request.Answer(0x01))
 			return err
 		}
-		defer listener.Close()
+		defer s.server.releaseTCPBind(bind)
 
-		tcpListener := listener.(*net.TCPListener)
-		tcpListener.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+		log.Infof("%s request tcp bind on %s", client, net.JoinHostPort(addr.Host(), strconv.Itoa(bind.port)))
+		s.conn.Write(s.request.AnswerBindAddr(0x05, 0x00, addr, uint16(bind.port)))
 
-		if s.config.Server.TCPBindAddrIsHostname {
-			log.Infof("%s request tcp bind on %s:%d", client, s.config.Server.TCPBindAddrHostname, port)
-			s.conn.Write(s.request.AnswerBindHostname(0x05, 0x00, s.config.Server.TCPBindAddrHostname, uint16(port)))
-		} else {
-			log.Infof("%s request tcp bind on [%s]:%d", client, s.config.Server.TCPBindAddrIP.String(), port)
-			s.conn.Write(s.request.AnswerBindIP(0x05, 0x00, s.config.Server.TCPBindAddrIP, uint16(port)))
-		}
-
-		remote, err := listener.Accept()
+		remote, err := bind.accept(s.server, s.user, client, expected)
 		if err != nil {
-			s.conn.Write(s.request.AnswerBindIP(0x05, 0x06, s.config.Server.TCPBindAddrIP, uint16(port)))
+			s.conn.Write(s.request.AnswerBindAddr(0x05, 0x06, addr, uint16(bind.port)))
 			return err
 		}
 		defer remote.Close()
@@ -418,32 +453,31 @@ func (s *socks5Client) Work() error {
 		log.Infof("%s get new tcp connection from %s", s.conn.RemoteAddr().String(), remote.RemoteAddr().String())
 		s.conn.Write(s.request.AnswerBindIP(0x05, 0x00, remoteAddr.IP, uint16(remoteAddr.Port)))
 
-		go proxyChannel(s.config, s.conn, remote)
-		proxyChannel(s.config, remote, s.conn)
+		usage := s.server.quota.usage(s.user)
+		go proxyChannel(s.config, s.conn, remote, usage)
+		proxyChannel(s.config, remote, s.conn, usage)
 
 		return nil
 	} else if s.request.command == 0x03 {
 		// UDP ASSOCIATION
-		port, err := s.server.GetUDPPort()
-		if err != nil {
-			s.conn.Write(s.request.Answer(0x01))
-			return err
-		}
-		defer s.server.FreeUDPPort(port)
-
 		var listener net.PacketConn
-		if s.config.Server.TCPBindAddrIsHostname {
-			listener, err = net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.config.Server.UDPAssociationAddrHostname, port))
-		} else {
-			listener, err = net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.config.Server.UDPAssociationAddrIP.String(), port))
-		}
+		port, err := s.server.udpPorts.Listen(portOwner(s.conn, s.user), func(port int) error {
+			var err error
+			if s.config.Server.UDPAssociationAddrIsHostname {
+				listener, err = net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.config.Server.UDPAssociationAddrHostname, port))
+			} else {
+				listener, err = net.ListenPacket("udp", fmt.Sprintf("[%s]:%d", s.config.Server.UDPAssociationAddrIP.String(), port))
+			}
+			return err
+		})
 		if err != nil {
 			s.conn.Write(s.request.Answer(0x01))
 			return err
 		}
+		defer s.server.udpPorts.Free(port)
 		defer listener.Close()
 
-		if s.config.Server.TCPBindAddrIsHostname {
+		if s.config.Server.UDPAssociationAddrIsHostname {
 			log.Infof("%s request udp association to %s:%d", client, s.config.Server.UDPAssociationAddrHostname, port)
 			s.conn.Write(s.request.AnswerBindHostname(0x05, 0x00, s.config.Server.UDPAssociationAddrHostname, uint16(port)))
 		} else {
@@ -451,7 +485,13 @@ func (s *socks5Client) Work() error {
 			s.conn.Write(s.request.AnswerBindIP(0x05, 0x00, s.config.Server.UDPAssociationAddrIP, uint16(port)))
 		}
 
-		go udpAssociate(s.config, listener)
+		association := newUDPAssociation(s.server, s.user, client, s.conn.RemoteAddr().(*net.TCPAddr).IP, listener, s.request.ip, s.request.port)
+		go func() {
+			// Association ends with control connection, so it's closed, when quota is spent.
+			if err := association.Work(); errors.Is(err, errQuotaExceeded) {
+				s.conn.Close()
+			}
+		}()
 
 		ignore := make([]byte, 32)
 		for {
@@ -460,6 +500,20 @@ func (s *socks5Client) Work() error {
 				return nil
 			}
 		}
+	} else if s.request.command == socks5CommandUDPTunnel {
+		// UDP OVER TCP
+		relay, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			s.conn.Write(s.request.Answer(0x01))
+			return err
+		}
+		defer relay.Close()
+
+		relayAddr := relay.LocalAddr().(*net.UDPAddr)
+		log.Infof("%s request udp over tcp, relaying from port %d", client, relayAddr.Port)
+		s.conn.Write(s.request.AnswerBindIP(0x05, 0x00, net.IPv4zero, uint16(relayAddr.Port)))
+
+		return udpTunnel(s.server, s.user, client, s.conn, s.reader, relay)
 	}
 
 	return fmt.Errorf("socks5 client send unknown command and somehow it was validated")
@@ -27,6 +27,8 @@ import (
 	"net"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
 	"virgild/models"
 )
 
@@ -36,15 +38,43 @@ func connectIP(s *Server, user *models.User, ip net.IP, port uint16) (net.Conn,
 		return nil, err
 	}
 
-	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: ip, Port: int(port)})
+	c, err := dialIP(s, user, ip, port)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	return s.limitConnection(user, c), nil
+}
+
+// dialIP connects to already checked destination directly, through relay or upstream, selected by user.
+func dialIP(s *Server, user *models.User, ip net.IP, port uint16) (net.Conn, error) {
+	if s.relay != nil {
+		return s.relay.dial(ip.String(), port)
+	}
+	if upstream := userUpstream(s, user); upstream != nil {
+		return dialUpstream(s, []*models.UpstreamConfig{upstream}, ip.String(), port)
+	}
+
+	return dialDirect(s, user, ip, port)
 }
 
 func connectHostname(s *Server, user *models.User, host string, port uint16) (net.Conn, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return connectIP(s, user, ip, port)
+	}
+
+	// Hostname is resolved by relay server, it checks remote subnets rules by itself. But ACLs of user
+	// are known only here, so with them hostname is resolved by us. Upstream proxies don't check our
+	// rules, so for them hostname is always resolved and checked here, upstream gets ip.
+	if s.relay != nil && (user == nil || len(user.ACL) == 0) {
+		c, err := s.relay.dial(host, port)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.limitConnection(user, c), nil
+	}
+
 	ips, err := net.LookupIP(host)
 	if err != nil {
 		return nil, err
@@ -56,16 +86,36 @@ func connectHostname(s *Server, user *models.User, host string, port uint16) (ne
 			return nil, err
 		}
 
-		c, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: ip, Port: int(port)})
+		c, err := dialIP(s, user, ip, port)
 		if err == nil {
-			return c, nil
+			return s.limitConnection(user, c), nil
 		}
 	}
 
 	return nil, fmt.Errorf("destination host unreachable")
 }
 
-func proxyChannel(config *models.Config, from net.Conn, to net.Conn) {
+// proxyConnection proxies data between client and remote, intercepting tls if configured.
+func proxyConnection(s *Server, user *models.User, client string, conn net.Conn, remote net.Conn, hostname string, port uint16) error {
+	if err := sendProxyProtocol(s, conn, remote); err != nil {
+		conn.Close()
+		remote.Close()
+		return err
+	}
+
+	usage := s.quota.usage(user)
+	if s.mitm != nil && s.mitm.applies(user, port) {
+		return s.mitm.intercept(s.config, client, conn, remote, hostname, usage)
+	}
+
+	go proxyChannel(s.config, conn, remote, usage)
+	proxyChannel(s.config, remote, conn, usage)
+
+	return nil
+}
+
+// proxyChannel copies data from one connection to another, counting it by usage of user, if he has quota.
+func proxyChannel(config *models.Config, from net.Conn, to net.Conn, usage *quotaUsage) {
 	defer from.Close()
 	defer to.Close()
 
@@ -87,5 +137,12 @@ func proxyChannel(config *models.Config, from net.Conn, to net.Conn) {
 		if err != nil {
 			return
 		}
+
+		if usage != nil {
+			if err = usage.add(ret); err != nil {
+				log.Errorln("user:", usage.user.Name, "quota error:", err)
+				return
+			}
+		}
 	}
 }
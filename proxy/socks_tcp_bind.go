@@ -21,3 +21,204 @@ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 SOFTWARE. */
 
 package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// tcpBind is listener of bind request. Kept open bind is reused only by the same owner
+// (user or anonymous client) from the same host.
+type tcpBind struct {
+	client   string
+	owner    string
+	addr     *models.BindAddr
+	port     int
+	listener *net.TCPListener
+
+	inUse bool
+	timer *time.Timer
+}
+
+// selectTCPBindAddr returns bind address with the same ip family, as client used to connect to us.
+// Hostnames fits any family. If ipv4Only is set (socks4), only addresses with ipv4 will be used.
+func selectTCPBindAddr(s *Server, conn net.Conn, ipv4Only bool) (*models.BindAddr, error) {
+	clientIPv4 := true
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		clientIPv4 = addr.IP.To4() != nil
+	}
+
+	var fallback *models.BindAddr
+	for _, addr := range s.config.Server.TCPBindAddrs {
+		if ipv4Only {
+			if _, ok := addr.LookupIPv4(); ok {
+				return addr, nil
+			}
+			continue
+		}
+
+		if addr.IsHostname() || addr.IsIPv4() == clientIPv4 {
+			return addr, nil
+		}
+		if fallback == nil {
+			fallback = addr
+		}
+	}
+
+	if fallback == nil {
+		if ipv4Only {
+			return nil, fmt.Errorf("can't find ipv4 address for tcp binding, please, check your config")
+		}
+		return nil, fmt.Errorf("can't find address for tcp binding, please, check your config")
+	}
+
+	return fallback, nil
+}
+
+func clientHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// portOwner returns name, that will be used for ports quota.
+func portOwner(conn net.Conn, user *models.User) string {
+	if user != nil {
+		return user.Name
+	}
+
+	return clientHost(conn)
+}
+
+// getTCPBind returns listener for tcp binding. If TCPBindKeepOpen enabled, client will get
+// the same listener (and port) as it had in previous bind request, like FTP clients expect.
+func (s *Server) getTCPBind(conn net.Conn, user *models.User, addr *models.BindAddr) (*tcpBind, error) {
+	client := clientHost(conn)
+	owner := portOwner(conn, user)
+
+	if s.config.Server.TCPBindKeepOpen > 0 {
+		s.tcpBindsMutex.Lock()
+		for _, bind := range s.tcpBinds {
+			if bind.client == client && bind.owner == owner && bind.addr == addr && !bind.inUse {
+				bind.inUse = true
+				bind.timer.Stop()
+				s.tcpBindsMutex.Unlock()
+
+				return bind, nil
+			}
+		}
+		s.tcpBindsMutex.Unlock()
+	}
+
+	var listener net.Listener
+	port, err := s.tcpPorts.Listen(owner, func(port int) error {
+		var err error
+		listener, err = net.Listen("tcp", net.JoinHostPort(addr.Host(), strconv.Itoa(port)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bind := &tcpBind{
+		client:   client,
+		owner:    owner,
+		addr:     addr,
+		port:     port,
+		listener: listener.(*net.TCPListener),
+		inUse:    true,
+	}
+
+	if s.config.Server.TCPBindKeepOpen > 0 {
+		s.tcpBindsMutex.Lock()
+		s.tcpBinds = append(s.tcpBinds, bind)
+		s.tcpBindsMutex.Unlock()
+	}
+
+	return bind, nil
+}
+
+func (s *Server) releaseTCPBind(bind *tcpBind) {
+	if s.config.Server.TCPBindKeepOpen <= 0 {
+		bind.listener.Close()
+		s.tcpPorts.Free(bind.port)
+		return
+	}
+
+	s.tcpBindsMutex.Lock()
+	defer s.tcpBindsMutex.Unlock()
+
+	bind.inUse = false
+	bind.timer = time.AfterFunc(time.Duration(s.config.Server.TCPBindKeepOpen)*time.Second, func() {
+		s.tcpBindsMutex.Lock()
+		defer s.tcpBindsMutex.Unlock()
+
+		if bind.inUse {
+			return
+		}
+
+		for i, b := range s.tcpBinds {
+			if b == bind {
+				s.tcpBinds = append(s.tcpBinds[:i], s.tcpBinds[i+1:]...)
+				break
+			}
+		}
+
+		bind.listener.Close()
+		s.tcpPorts.Free(bind.port)
+		log.Debugf("tcp bind on port %d for %s closed", bind.port, bind.client)
+	})
+}
+
+// lookupBindPeer returns ip addresses, from which we expect incoming connection. Empty list means any.
+func lookupBindPeer(ip net.IP, hostname string) ([]net.IP, error) {
+	if len(hostname) > 0 {
+		return net.LookupIP(hostname)
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return nil, nil
+	}
+
+	return []net.IP{ip}, nil
+}
+
+// accept waits for connection from expected peer, all other connections will be dropped.
+func (b *tcpBind) accept(s *Server, user *models.User, client string, expected []net.IP) (net.Conn, error) {
+	b.listener.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+
+	for {
+		remote, err := b.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		remoteIP := remote.RemoteAddr().(*net.TCPAddr).IP
+		if err = checkRemoteSubnetsRules(s, user, remoteIP); err != nil {
+			log.Infof("%s tcp bind rejected connection from %s: %s", client, remote.RemoteAddr().String(), err)
+			remote.Close()
+			continue
+		}
+
+		if len(expected) == 0 {
+			return remote, nil
+		}
+
+		for _, ip := range expected {
+			if ip.Equal(remoteIP) {
+				return remote, nil
+			}
+		}
+
+		log.Infof("%s tcp bind rejected connection from %s: not requested peer", client, remote.RemoteAddr().String())
+		remote.Close()
+	}
+}
@@ -25,6 +25,7 @@ package proxy
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -34,87 +35,128 @@ import (
 	"virgild/models"
 )
 
-func udpSendSocksPacket(listener net.PacketConn, from *net.UDPAddr, data []byte) error {
+// RFC 1928 asks for at least 5 seconds for fragments reassembly.
+const udpFragmentsTimeout = 5 * time.Second
+
+// Filtering of replies from remote peers, same meaning as in RFC 4787 for NAT.
+const (
+	udpFilteringEndpointIndependent  = "endpoint-independent"
+	udpFilteringAddressDependent     = "address-dependent"
+	udpFilteringAddressPortDependent = "address-port-dependent"
+	udpFilteringDefault              = udpFilteringAddressPortDependent
+	udpFlowsDefaultTimeout           = 60 * time.Second
+	udpFlowsCleanupInterval          = time.Second
+)
+
+type udpPacket struct {
+	frag     byte
+	ip       net.IP
+	hostname string
+	port     uint16
+	data     []byte
+}
+
+type udpFragments struct {
+	first    *udpPacket
+	position byte
+	deadline time.Time
+	data     []byte
+}
+
+type udpFlow struct {
+	addr     *net.UDPAddr
+	started  time.Time
+	lastSeen time.Time
+
+	packetsOut uint64
+	packetsIn  uint64
+	bytesOut   uint64
+	bytesIn    uint64
+}
+
+type udpAssociation struct {
+	server *Server
+	user   *models.User
+	usage  *quotaUsage
+	client string
+
+	// Only packets from this ip are accepted as client packets. If clientPort
+	// is zero (client didn't send it in request), we will take port from the first packet.
+	clientIP   net.IP
+	clientPort int
+	clientAddr *net.UDPAddr
+
+	relay        net.PacketConn
+	sendToClient func(data []byte) error
+
+	fragments udpFragments
+
+	filtering    string
+	flows        map[string]*udpFlow
+	flowsTimeout time.Duration
+	flowsCleanup time.Time
+
+	packetsOut uint64
+	packetsIn  uint64
+	bytesOut   uint64
+	bytesIn    uint64
+	dropped    uint64
+}
+
+func parseUDPPacket(data []byte) (*udpPacket, error) {
 	headerLen := 4
 	dataLen := len(data)
 	if dataLen < headerLen {
-		return fmt.Errorf("socks5 udp packet header length < %d", headerLen)
+		return nil, fmt.Errorf("socks5 udp packet header length < %d", headerLen)
 	}
 
 	if data[0] != 0x00 || data[1] != 0x00 {
-		return fmt.Errorf("socks5 udp packet header RSV not null")
-	}
-	if data[2] != 0x00 {
-		return fmt.Errorf("socks5 udp packet fragmentation not supported, packet dropped")
+		return nil, fmt.Errorf("socks5 udp packet header RSV not null")
 	}
 
-	var ip net.IP
-	var hostname string
+	packet := &udpPacket{frag: data[2]}
 
 	if data[3] == 0x01 {
 		headerLen += 4
 		if dataLen < headerLen {
-			return fmt.Errorf("socks5 udp packet header length < %d", headerLen)
+			return nil, fmt.Errorf("socks5 udp packet header length < %d", headerLen)
 		}
 
-		ip = data[4:8]
-	} else if data[3] == 0x02 {
+		packet.ip = net.IP(data[4:8])
+	} else if data[3] == 0x03 {
 		headerLen++
 		if dataLen < headerLen {
-			return fmt.Errorf("socks5 udp packet header length < %d", headerLen)
+			return nil, fmt.Errorf("socks5 udp packet header length < %d", headerLen)
 		}
 		headerLen += int(data[4])
 		if dataLen < headerLen {
-			return fmt.Errorf("socks5 udp packet header length < %d", headerLen)
+			return nil, fmt.Errorf("socks5 udp packet header length < %d", headerLen)
 		}
 
-		hostname = string(data[5:int(data[4])])
-	} else if data[3] == 0x03 {
+		packet.hostname = string(data[5:headerLen])
+	} else if data[3] == 0x04 {
 		headerLen += 16
 		if dataLen < headerLen {
-			return fmt.Errorf("socks5 udp packet header length < %d", headerLen)
+			return nil, fmt.Errorf("socks5 udp packet header length < %d", headerLen)
 		}
 
-		ip = data[4:20]
+		packet.ip = net.IP(data[4:20])
 	} else {
-		return fmt.Errorf("socks5 udp packet header unknown address type")
+		return nil, fmt.Errorf("socks5 udp packet header unknown address type")
 	}
 
 	headerLen += 2
 	if dataLen < headerLen {
-		return fmt.Errorf("socks5 udp packet header length < %d", headerLen)
+		return nil, fmt.Errorf("socks5 udp packet header length < %d", headerLen)
 	}
 
-	port := binary.BigEndian.Uint16(data[headerLen-2 : headerLen])
+	packet.port = binary.BigEndian.Uint16(data[headerLen-2 : headerLen])
+	packet.data = data[headerLen:]
 
-	if len(hostname) > 0 {
-		ips, err := net.LookupIP(hostname)
-		if err != nil {
-			return err
-		}
-
-		for _, ip := range ips {
-			to := &net.UDPAddr{IP: ip, Port: int(port)}
-
-			_, err = listener.WriteTo(data[headerLen:], to)
-			if err == nil {
-				log.Debugf("%s sending udp to %s", from.String(), to.String())
-				return nil
-			}
-
-			return fmt.Errorf("udp lookup failed: destination host unreachable")
-		}
-	} else {
-		to := &net.UDPAddr{IP: ip, Port: int(port)}
-		log.Debugf("%s sending udp to %s", from.String(), to.String())
-
-		listener.WriteTo(data[headerLen:], to)
-	}
-
-	return nil
+	return packet, nil
 }
 
-func udpRelayPacket(listener net.PacketConn, from *net.UDPAddr, to *net.UDPAddr, data []byte) error {
+func buildUDPPacket(from *net.UDPAddr, data []byte) ([]byte, error) {
 	var buffer bytes.Buffer
 
 	// RSV
@@ -124,60 +166,317 @@ func udpRelayPacket(listener net.PacketConn, from *net.UDPAddr, to *net.UDPAddr,
 	// FRAG
 	buffer.WriteByte(0x00)
 
-	if len(from.IP) == 4 {
+	if ip := from.IP.To4(); ip != nil {
 		buffer.WriteByte(0x01)
-		binary.Write(&buffer, binary.LittleEndian, from.IP)
-	} else if len(from.IP) == 16 {
-		buffer.WriteByte(0x03)
-		binary.Write(&buffer, binary.LittleEndian, from.IP)
+		buffer.Write(ip)
+	} else if len(from.IP) == net.IPv6len {
+		buffer.WriteByte(0x04)
+		buffer.Write(from.IP)
 	} else {
-		return fmt.Errorf("socks5 udp packet has unknown address type")
+		return nil, fmt.Errorf("socks5 udp packet has unknown address type")
 	}
 
 	binary.Write(&buffer, binary.BigEndian, uint16(from.Port))
 
 	// DATA
-	binary.Write(&buffer, binary.LittleEndian, data)
+	buffer.Write(data)
+
+	return buffer.Bytes(), nil
+}
+
+func (a *udpAssociation) isClient(addr *net.UDPAddr) bool {
+	if !a.clientIP.Equal(addr.IP) {
+		return false
+	}
+
+	if a.clientAddr == nil {
+		if a.clientPort != 0 && a.clientPort != addr.Port {
+			return false
+		}
 
-	log.Debugf("%s relaying udp to %s", from.String(), to.String())
+		a.clientAddr = addr
+		return true
+	}
+
+	return a.clientAddr.Port == addr.Port
+}
+
+func (a *udpAssociation) reassemble(packet *udpPacket) *udpPacket {
+	if packet.frag == 0x00 {
+		// Standalone packet abandons any fragments we have.
+		a.fragments = udpFragments{}
+		return packet
+	}
 
-	listener.WriteTo(buffer.Bytes(), to)
+	position := packet.frag & 0x7F
+	if a.fragments.first != nil {
+		if time.Now().After(a.fragments.deadline) || position <= a.fragments.position {
+			log.Debugf("%s udp fragments sequence dropped", a.client)
+			a.fragments = udpFragments{}
+		}
+	}
+
+	if a.fragments.first == nil {
+		if position != 0x01 {
+			log.Debugf("%s udp fragment %d dropped, sequence must start from 1", a.client, position)
+			return nil
+		}
 
-	return nil
+		a.fragments.first = packet
+		a.fragments.deadline = time.Now().Add(udpFragmentsTimeout)
+	}
+
+	if len(a.fragments.data)+len(packet.data) > 65535 {
+		log.Debugf("%s udp fragments sequence too long, dropped", a.client)
+		a.fragments = udpFragments{}
+		return nil
+	}
+
+	a.fragments.position = position
+	a.fragments.data = append(a.fragments.data, packet.data...)
+
+	if packet.frag&0x80 == 0 {
+		return nil
+	}
+
+	complete := &udpPacket{
+		ip:       a.fragments.first.ip,
+		hostname: a.fragments.first.hostname,
+		port:     a.fragments.first.port,
+		data:     a.fragments.data,
+	}
+	a.fragments = udpFragments{}
+
+	return complete
+}
+
+func (a *udpAssociation) clientPacket(data []byte) error {
+	packet, err := parseUDPPacket(data)
+	if err != nil {
+		return err
+	}
+
+	if packet.frag != 0x00 {
+		// Fragments data will be stored until the end of sequence, so copy it out of read buffer.
+		packet.data = append([]byte{}, packet.data...)
+		packet.ip = append(net.IP{}, packet.ip...)
+	}
+
+	if packet = a.reassemble(packet); packet == nil {
+		return nil
+	}
+
+	return a.sendToRemote(packet)
 }
 
-func udpAssociate(config *models.Config, listener net.PacketConn) error {
+func (a *udpAssociation) sendToRemote(packet *udpPacket) error {
+	var ips []net.IP
+	if len(packet.hostname) > 0 {
+		var err error
+		if ips, err = net.LookupIP(packet.hostname); err != nil {
+			return err
+		}
+	} else {
+		ips = []net.IP{packet.ip}
+	}
+
+	for _, ip := range ips {
+		if err := checkRemoteSubnetsRules(a.server, a.user, ip); err != nil {
+			return err
+		}
+
+		to := &net.UDPAddr{IP: ip, Port: int(packet.port)}
+		if _, err := a.relay.WriteTo(packet.data, to); err == nil {
+			log.Debugf("%s sending udp to %s", a.client, to.String())
+			a.outbound(to, len(packet.data))
+			return a.count(len(packet.data))
+		}
+	}
+
+	return fmt.Errorf("destination host unreachable")
+}
+
+func (a *udpAssociation) outbound(to *net.UDPAddr, size int) {
+	now := time.Now()
+
+	key := to.String()
+	flow, ok := a.flows[key]
+	if !ok {
+		flow = &udpFlow{addr: to, started: now}
+		a.flows[key] = flow
+		log.Debugf("%s new udp flow to %s", a.client, key)
+	}
+
+	flow.lastSeen = now
+	flow.packetsOut++
+	flow.bytesOut += uint64(size)
+
+	a.packetsOut++
+	a.bytesOut += uint64(size)
+}
+
+// inbound returns flow, that allows us to relay packet from remote peer to client, or nil if packet must be dropped.
+func (a *udpAssociation) inbound(from *net.UDPAddr, size int) *udpFlow {
+	now := time.Now()
+
+	key := from.String()
+	flow, ok := a.flows[key]
+	if !ok {
+		if a.filtering == udpFilteringAddressPortDependent || len(a.flows) == 0 {
+			return nil
+		}
+
+		if a.filtering == udpFilteringAddressDependent {
+			contacted := false
+			for _, f := range a.flows {
+				if f.addr.IP.Equal(from.IP) {
+					contacted = true
+					break
+				}
+			}
+			if !contacted {
+				return nil
+			}
+		}
+
+		flow = &udpFlow{addr: from, started: now}
+		a.flows[key] = flow
+	}
+
+	flow.lastSeen = now
+	flow.packetsIn++
+	flow.bytesIn += uint64(size)
+
+	a.packetsIn++
+	a.bytesIn += uint64(size)
+
+	return flow
+}
+
+func (a *udpAssociation) expireFlows(force bool) {
+	now := time.Now()
+	if !force && now.Before(a.flowsCleanup) {
+		return
+	}
+	a.flowsCleanup = now.Add(udpFlowsCleanupInterval)
+
+	for key, flow := range a.flows {
+		if force || now.Sub(flow.lastSeen) > a.flowsTimeout {
+			log.Debugf("%s udp flow %s closed after %s, sent %d packets (%d bytes), received %d packets (%d bytes)",
+				a.client, key, flow.lastSeen.Sub(flow.started).Round(time.Second), flow.packetsOut, flow.bytesOut, flow.packetsIn, flow.bytesIn)
+			delete(a.flows, key)
+		}
+	}
+}
+
+func (a *udpAssociation) remotePacket(from *net.UDPAddr, data []byte) error {
+	if a.inbound(from, len(data)) == nil {
+		a.dropped++
+		return fmt.Errorf("udp packet from %s dropped, client didn't contact this peer", from.String())
+	}
+
+	packet, err := buildUDPPacket(from, data)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("%s relaying udp from %s", a.client, from.String())
+
+	if err = a.sendToClient(packet); err != nil {
+		return err
+	}
+
+	return a.count(len(data))
+}
+
+// count adds relayed data to traffic of user, if he has quota.
+func (a *udpAssociation) count(size int) error {
+	if a.usage == nil {
+		return nil
+	}
+
+	return a.usage.add(size)
+}
+
+func (a *udpAssociation) Work() error {
 	var ret int
 	var addr net.Addr
-	var client, remote *net.UDPAddr
 	var err error
 
 	// I want to make sure, that we don't have fragmentation in udp.
 	buffer := make([]byte, 65535)
 
-	timeoutDuration := time.Duration(config.Server.Timeout) * time.Second
+	timeoutDuration := time.Duration(a.server.config.Server.Timeout) * time.Second
+
+	defer a.Close()
 
 	for {
-		listener.SetReadDeadline(time.Now().Add(timeoutDuration))
+		a.relay.SetReadDeadline(time.Now().Add(timeoutDuration))
 
-		ret, addr, err = listener.ReadFrom(buffer)
+		ret, addr, err = a.relay.ReadFrom(buffer)
 		if err != nil {
 			return err
 		}
-		remote = addr.(*net.UDPAddr)
+		from := addr.(*net.UDPAddr)
 
-		if client == nil {
-			client = remote
-		}
+		a.expireFlows(false)
 
-		if bytes.Equal(client.IP, remote.IP) && client.Port == remote.Port {
-			err = udpSendSocksPacket(listener, client, buffer[0:ret])
-		} else {
-			err = udpRelayPacket(listener, remote, client, buffer[0:ret])
+		if a.isClient(from) {
+			err = a.clientPacket(buffer[0:ret])
+		} else if a.clientAddr != nil {
+			err = a.remotePacket(from, buffer[0:ret])
 		}
 
+		if errors.Is(err, errQuotaExceeded) {
+			log.Errorln("client:", a.client, "quota error:", err)
+			return err
+		}
 		if err != nil {
-			log.Debugf("(udp association)", err)
+			log.Debugln("(udp association)", err)
 		}
 	}
 }
+
+func (a *udpAssociation) Close() {
+	a.expireFlows(true)
+
+	log.Infof("%s udp association closed, sent %d packets (%d bytes), received %d packets (%d bytes), dropped %d packets",
+		a.client, a.packetsOut, a.bytesOut, a.packetsIn, a.bytesIn, a.dropped)
+}
+
+func newUDPAssociation(s *Server, user *models.User, client string, clientIP net.IP, listener net.PacketConn, requestIP net.IP, requestPort uint16) *udpAssociation {
+	a := &udpAssociation{
+		server: s,
+		user:   user,
+		usage:  s.quota.usage(user),
+		client: client,
+
+		clientIP:   clientIP,
+		clientPort: int(requestPort),
+
+		relay: listener,
+
+		filtering:    s.config.Server.UDPAssociationFiltering,
+		flows:        map[string]*udpFlow{},
+		flowsTimeout: time.Duration(s.config.Server.UDPAssociationFlowTimeout) * time.Second,
+	}
+	if len(a.filtering) == 0 {
+		a.filtering = udpFilteringDefault
+	}
+	if a.flowsTimeout <= 0 {
+		a.flowsTimeout = udpFlowsDefaultTimeout
+	}
+
+	// Client may send address, from which it will send packets. We trust only the ip of control
+	// connection (client may be behind nat and don't know its external ip), so just log it.
+	if requestIP != nil && !requestIP.IsUnspecified() && !requestIP.Equal(a.clientIP) {
+		log.Debugf("%s udp association requested from %s, but control connection is from %s", client, requestIP.String(), a.clientIP.String())
+	}
+
+	a.sendToClient = func(data []byte) error {
+		_, err := a.relay.WriteTo(data, a.clientAddr)
+		return err
+	}
+
+	return a
+}
@@ -0,0 +1,168 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// UDP over TCP is not a part of RFC 1928, but some socks implementations (gost, for example) have it as
+// extension command 0xF3. Datagrams are sent over control connection in the same format as for
+// udp association, except RSV field, that contains length of the DATA.
+const socks5CommandUDPTunnel = 0xF3
+
+func readUDPTunnelFrame(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	dataLen := int(binary.BigEndian.Uint16(header[0:2]))
+
+	var addrLen int
+	if header[3] == 0x01 {
+		addrLen = 4
+	} else if header[3] == 0x03 {
+		t, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, t)
+		addrLen = int(t)
+	} else if header[3] == 0x04 {
+		addrLen = 16
+	} else {
+		return nil, fmt.Errorf("socks5 udp tunnel frame header unknown address type")
+	}
+
+	frame := make([]byte, len(header)+addrLen+2+dataLen)
+	copy(frame, header)
+	if _, err := io.ReadFull(reader, frame[len(header):]); err != nil {
+		return nil, err
+	}
+
+	// Now it's a usual socks5 udp packet.
+	frame[0] = 0x00
+	frame[1] = 0x00
+
+	return frame, nil
+}
+
+func udpTunnel(s *Server, user *models.User, client string, conn net.Conn, reader *bufio.Reader, relay net.PacketConn) error {
+	a := newUDPAssociation(s, user, client, conn.RemoteAddr().(*net.TCPAddr).IP, relay, nil, 0)
+
+	writeMutex := &sync.Mutex{}
+	a.sendToClient = func(data []byte) error {
+		if len(data) > 0xFFFF {
+			return fmt.Errorf("socks5 udp tunnel frame too long")
+		}
+
+		// Replace RSV with length of the DATA, header is always 4 + address + 2 bytes.
+		headerLen := 4 + 2
+		if data[3] == 0x01 {
+			headerLen += 4
+		} else {
+			headerLen += 16
+		}
+		binary.BigEndian.PutUint16(data[0:2], uint16(len(data)-headerLen))
+
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+
+		_, err := conn.Write(data)
+		return err
+	}
+
+	// Both sides of tunnel use association in parallel.
+	associationMutex := &sync.Mutex{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buffer := make([]byte, 65535)
+		for {
+			ret, addr, err := relay.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			associationMutex.Lock()
+			a.expireFlows(false)
+			err = a.remotePacket(addr.(*net.UDPAddr), buffer[0:ret])
+			associationMutex.Unlock()
+
+			if errors.Is(err, errQuotaExceeded) {
+				log.Errorln("client:", client, "quota error:", err)
+				conn.Close()
+				return
+			}
+			if err != nil {
+				log.Debugln("(udp tunnel)", err)
+			}
+		}
+	}()
+
+	// Reader of relay uses association too, so it's stopped before association is closed.
+	defer func() {
+		relay.Close()
+		<-done
+		a.Close()
+	}()
+
+	timeoutDuration := time.Duration(s.config.Server.Timeout) * time.Second
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeoutDuration))
+
+		frame, err := readUDPTunnelFrame(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		associationMutex.Lock()
+		err = a.clientPacket(frame)
+		associationMutex.Unlock()
+
+		if errors.Is(err, errQuotaExceeded) {
+			return err
+		}
+		if err != nil {
+			log.Debugln("(udp tunnel)", err)
+		}
+	}
+}
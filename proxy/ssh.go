@@ -0,0 +1,287 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"virgild/models"
+)
+
+// sshListener accepts ssh clients for dynamic (ssh -D) and local (ssh -L) forwarding only, without shell.
+type sshListener struct {
+	config    *models.SSHConfig
+	listener  net.Listener
+	sshConfig *ssh.ServerConfig
+}
+
+// Payload of direct-tcpip channel open request (RFC 4254, section 7.2).
+type sshDirectTCPIP struct {
+	Host     string
+	Port     uint32
+	OrigHost string
+	OrigPort uint32
+}
+
+func newSSHListener(config *models.SSHConfig, allowAnonymous bool, authMethods []models.AuthMethod) (*sshListener, error) {
+	l := &sshListener{config: config}
+
+	l.sshConfig = &ssh.ServerConfig{
+		NoClientAuth:  allowAnonymous,
+		ServerVersion: "SSH-2.0-virgild",
+	}
+	if len(config.AuthorizedKeys) > 0 {
+		l.sshConfig.PublicKeyCallback = l.checkPublicKey
+	}
+	if config.PasswordAuth && len(authMethods) > 0 {
+		l.sshConfig.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			for _, method := range authMethods {
+				ok, err := method.Check(meta.User(), string(password))
+				if err != nil {
+					log.Errorln("(auth)", err)
+				}
+				if ok {
+					return &ssh.Permissions{Extensions: map[string]string{"user": meta.User()}}, nil
+				}
+			}
+
+			return nil, fmt.Errorf("ssh client with username: \"%s\" don't exists in our db", meta.User())
+		}
+	}
+
+	for _, path := range config.HostKey {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("ssh host key %s: %s", path, err)
+		}
+		l.sshConfig.AddHostKey(key)
+	}
+
+	var err error
+	if l.listener, err = net.Listen("tcp", config.Bind); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// checkPublicKey looks for client key in authorized_keys file, "%u" in path is replaced by username.
+// Shared file (without "%u") has keys of all users, then comment of key must be username, it's bound to.
+// File is read on every login, so keys can be changed without restart.
+func (l *sshListener) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if strings.ContainsAny(meta.User(), "/\\") || meta.User() == ".." {
+		return nil, fmt.Errorf("ssh client with wrong username: \"%s\"", meta.User())
+	}
+
+	shared := !strings.Contains(l.config.AuthorizedKeys, "%u")
+	data, err := ioutil.ReadFile(strings.Replace(l.config.AuthorizedKeys, "%u", meta.User(), -1))
+	if err != nil {
+		return nil, err
+	}
+
+	for len(data) > 0 {
+		var authorized ssh.PublicKey
+		var comment string
+		if authorized, comment, _, data, err = ssh.ParseAuthorizedKey(data); err != nil {
+			break
+		}
+		if shared && comment != meta.User() {
+			continue
+		}
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"user": meta.User()}}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("ssh client with username: \"%s\" has unknown key", meta.User())
+}
+
+func (l *sshListener) serve(s *Server) {
+	for s.work {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if s.work {
+				log.Errorln("(ssh)", err)
+			}
+			continue
+		}
+
+		go handleSSH(s, l, conn)
+	}
+}
+
+func (l *sshListener) Close() error {
+	return l.listener.Close()
+}
+
+func handleSSH(s *Server, l *sshListener, conn net.Conn) {
+	conn, err := acceptProxyProtocol(s, conn)
+	if err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "proxy protocol error:", err)
+		conn.Close()
+		return
+	}
+	defer conn.Close()
+
+	sess := s.sessions.add("ssh", conn)
+	defer s.sessions.remove(sess)
+	sess.setProtocol("ssh")
+	conn = sess.conn
+
+	client := conn.RemoteAddr().String()
+
+	conn.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, l.sshConfig)
+	if err != nil {
+		log.Errorln("client:", client, "auth error:", err)
+		s.stats.authFailed()
+		return
+	}
+	defer sshConn.Close()
+	conn.SetDeadline(time.Time{})
+
+	var user *models.User
+	if sshConn.Permissions != nil && len(sshConn.Permissions.Extensions["user"]) > 0 {
+		if user, err = loadUser(s, sshConn.Permissions.Extensions["user"]); err != nil {
+			log.Errorln("client:", client, "auth error:", err)
+			s.stats.authFailed()
+			return
+		}
+	}
+
+	if err = checkUserProtocol(user, "ssh"); err != nil {
+		log.Errorln("client:", client, "security error:", err)
+		return
+	}
+
+	if err = checkSubnetsRules(s, user, conn); err != nil {
+		log.Errorln("client:", client, "security error:", err)
+		return
+	}
+
+	sess.setUser(user)
+
+	if err = checkSchedule(s, user, "ssh"); err != nil {
+		log.Errorln("client:", client, "schedule error:", err)
+		return
+	}
+
+	log.Infof("%s ssh session started (%s)", client, sshConn.User())
+	defer log.Infof("%s ssh session closed", client)
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only port forwarding is allowed")
+			continue
+		}
+
+		go handleSSHChannel(s, sess, user, client, conn, newChannel)
+	}
+}
+
+func handleSSHChannel(s *Server, sess *session, user *models.User, client string, conn net.Conn, newChannel ssh.NewChannel) {
+	var request sshDirectTCPIP
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &request); err != nil || request.Port > 0xFFFF {
+		newChannel.Reject(ssh.ConnectionFailed, "wrong direct-tcpip request")
+		log.Errorln("client:", client, "request error: wrong direct-tcpip request")
+		return
+	}
+
+	if err := checkUserCommand(user, "connect"); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		log.Errorln("client:", client, "auth error:", err)
+		return
+	}
+
+	// Session can live long, so quota is checked for every channel.
+	if err := checkUserQuota(s, user); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		log.Errorln("client:", client, "quota error:", err)
+		return
+	}
+
+	log.Infof("%s connecting to %s:%d", client, request.Host, request.Port)
+	sess.setDestination(net.JoinHostPort(request.Host, strconv.Itoa(int(request.Port))))
+
+	remote, err := connectHostname(s, user, request.Host, uint16(request.Port))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		log.Errorln("client:", client, "error:", err)
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		remote.Close()
+		log.Errorln("client:", client, "error:", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	err = proxyConnection(s, user, client, &sshChannelConn{Channel: channel, conn: conn}, remote, request.Host, uint16(request.Port))
+	if err != nil {
+		log.Errorln("client:", client, "error:", err)
+	}
+}
+
+// sshChannelConn is net.Conn on top of ssh channel. Channels have no deadlines, so idle timeout
+// is applied only to remote side of connection.
+type sshChannelConn struct {
+	ssh.Channel
+	conn net.Conn
+}
+
+func (c *sshChannelConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *sshChannelConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *sshChannelConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sshChannelConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sshChannelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,335 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statsInterval = time.Second
+	// Seconds of throughput history.
+	statsSamples = 300
+	// Top users and destinations are counted for the last minutes.
+	statsTopMinutes = 10
+	statsTopSize    = 10
+	statsErrorsSize = 50
+)
+
+type statsSample struct {
+	Time         time.Time `json:"time"`
+	Uploaded     int64     `json:"uploaded"`
+	Downloaded   int64     `json:"downloaded"`
+	Sessions     int       `json:"sessions"`
+	Opened       int64     `json:"opened"`
+	AuthFailures int64     `json:"authFailures"`
+}
+
+type statsTraffic struct {
+	Name       string `json:"name"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+type statsError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// statsReport is snapshot of statistics for dashboard.
+type statsReport struct {
+	Started      time.Time      `json:"started"`
+	Uploaded     int64          `json:"uploaded"`
+	Downloaded   int64          `json:"downloaded"`
+	Opened       int64          `json:"opened"`
+	AuthFailures int64          `json:"authFailures"`
+	Sessions     int            `json:"sessions"`
+	Listeners    map[string]int `json:"listeners"`
+	Protocols    map[string]int `json:"protocols"`
+	Samples      []statsSample  `json:"samples"`
+	Users        []statsTraffic `json:"users"`
+	Destinations []statsTraffic `json:"destinations"`
+	Errors       []statsError   `json:"errors"`
+}
+
+// statsCollector keeps rolling in-memory statistics: traffic of sessions is taken every second,
+// recent errors come from log hook. Methods are safe for nil collector, when admin api is off.
+type statsCollector struct {
+	started time.Time
+	mutex   *sync.Mutex
+
+	current statsSample
+	samples []statsSample
+
+	// Per-minute buckets, the last one is current.
+	bucketStart  time.Time
+	users        []map[string]*statsTraffic
+	destinations []map[string]*statsTraffic
+
+	uploaded     int64
+	downloaded   int64
+	opened       int64
+	authFailures int64
+
+	errors []statsError
+	done   chan struct{}
+}
+
+func newStatsCollector() *statsCollector {
+	now := time.Now()
+	return &statsCollector{
+		started:      now,
+		mutex:        &sync.Mutex{},
+		current:      statsSample{Time: now},
+		bucketStart:  now,
+		users:        []map[string]*statsTraffic{{}},
+		destinations: []map[string]*statsTraffic{{}},
+		done:         make(chan struct{}),
+	}
+}
+
+func (c *statsCollector) sessionOpened() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	c.current.Opened++
+	c.opened++
+	c.mutex.Unlock()
+}
+
+// sessionClosed counts the rest of traffic of session.
+func (c *statsCollector) sessionClosed(sess *session) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	c.account(sess)
+	sess.statsClosed = true
+	c.mutex.Unlock()
+}
+
+func (c *statsCollector) authFailed() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	c.current.AuthFailures++
+	c.authFailures++
+	c.mutex.Unlock()
+}
+
+// account adds traffic of session since the last call, mutex must be locked.
+func (c *statsCollector) account(sess *session) {
+	if sess.statsClosed {
+		return
+	}
+
+	uploaded := atomic.LoadInt64(&sess.uploaded)
+	downloaded := atomic.LoadInt64(&sess.downloaded)
+	up, down := uploaded-sess.statsReported[0], downloaded-sess.statsReported[1]
+	if up == 0 && down == 0 {
+		return
+	}
+	sess.statsReported = [2]int64{uploaded, downloaded}
+
+	c.current.Uploaded += up
+	c.current.Downloaded += down
+	c.uploaded += up
+	c.downloaded += down
+
+	sess.mutex.Lock()
+	user, destination := "", sess.destination
+	if sess.user != nil {
+		user = sess.user.Name
+	}
+	sess.mutex.Unlock()
+
+	if len(user) > 0 {
+		addTraffic(c.users[len(c.users)-1], user, up, down)
+	}
+	if len(destination) > 0 {
+		addTraffic(c.destinations[len(c.destinations)-1], destination, up, down)
+	}
+}
+
+func addTraffic(bucket map[string]*statsTraffic, name string, uploaded, downloaded int64) {
+	traffic, ok := bucket[name]
+	if !ok {
+		traffic = &statsTraffic{Name: name}
+		bucket[name] = traffic
+	}
+	traffic.Uploaded += uploaded
+	traffic.Downloaded += downloaded
+}
+
+// serve takes sample every second until Close.
+func (c *statsCollector) serve(sessions *sessionRegistry) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.sample(now, sessions.list())
+		}
+	}
+}
+
+func (c *statsCollector) sample(now time.Time, sessions []*session) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, sess := range sessions {
+		c.account(sess)
+	}
+
+	c.current.Sessions = len(sessions)
+	if len(c.samples) >= statsSamples {
+		copy(c.samples, c.samples[1:])
+		c.samples = c.samples[:statsSamples-1]
+	}
+	c.samples = append(c.samples, c.current)
+	c.current = statsSample{Time: now}
+
+	if now.Sub(c.bucketStart) >= time.Minute {
+		c.bucketStart = now
+		c.users = rotateBuckets(c.users)
+		c.destinations = rotateBuckets(c.destinations)
+	}
+}
+
+func rotateBuckets(buckets []map[string]*statsTraffic) []map[string]*statsTraffic {
+	buckets = append(buckets, map[string]*statsTraffic{})
+	if len(buckets) > statsTopMinutes {
+		buckets = buckets[len(buckets)-statsTopMinutes:]
+	}
+
+	return buckets
+}
+
+// top merges buckets and returns names with the most traffic.
+func top(buckets []map[string]*statsTraffic) []statsTraffic {
+	merged := map[string]*statsTraffic{}
+	for _, bucket := range buckets {
+		for name, traffic := range bucket {
+			addTraffic(merged, name, traffic.Uploaded, traffic.Downloaded)
+		}
+	}
+
+	list := make([]statsTraffic, 0, len(merged))
+	for _, traffic := range merged {
+		list = append(list, *traffic)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Uploaded+list[i].Downloaded > list[j].Uploaded+list[j].Downloaded
+	})
+	if len(list) > statsTopSize {
+		list = list[:statsTopSize]
+	}
+
+	return list
+}
+
+func (c *statsCollector) report(sessions []*session) *statsReport {
+	report := &statsReport{
+		Sessions:  len(sessions),
+		Listeners: map[string]int{},
+		Protocols: map[string]int{},
+	}
+	for _, sess := range sessions {
+		sess.mutex.Lock()
+		report.Listeners[sess.listener]++
+		if len(sess.protocol) > 0 {
+			report.Protocols[sess.protocol]++
+		}
+		sess.mutex.Unlock()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	report.Started = c.started
+	report.Uploaded = c.uploaded
+	report.Downloaded = c.downloaded
+	report.Opened = c.opened
+	report.AuthFailures = c.authFailures
+	report.Samples = append([]statsSample{}, c.samples...)
+	report.Users = top(c.users)
+	report.Destinations = top(c.destinations)
+	report.Errors = append([]statsError{}, c.errors...)
+
+	return report
+}
+
+// Levels and Fire make collector a log hook for recent errors.
+func (c *statsCollector) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (c *statsCollector) Fire(entry *log.Entry) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.errors) >= statsErrorsSize {
+		copy(c.errors, c.errors[1:])
+		c.errors = c.errors[:statsErrorsSize-1]
+	}
+	c.errors = append(c.errors, statsError{Time: entry.Time, Message: redactCredentials(entry.Message)})
+
+	return nil
+}
+
+// Errors are shown in dashboard, credentials from messages of clients and upstreams mustn't get there.
+var credentialsPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)((?:password|passwd|secret|token)"?\s*[:=]\s*)("[^"]*"|\S+)`), "${1}***"},
+	{regexp.MustCompile(`(?i)(authorization:\s*\w+\s+)\S+`), "${1}***"},
+	{regexp.MustCompile(`(://[^/@\s:]*:)[^/@\s]*@`), "${1}***@"},
+}
+
+func redactCredentials(message string) string {
+	for _, p := range credentialsPatterns {
+		message = p.pattern.ReplaceAllString(message, p.replacement)
+	}
+
+	return message
+}
+
+func (c *statsCollector) Close() error {
+	close(c.done)
+	return nil
+}
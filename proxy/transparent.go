@@ -0,0 +1,243 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type transparent struct {
+	mode     string
+	listener net.Listener
+	udp      *net.UDPConn
+	port     int
+
+	flows      map[string]*net.UDPConn
+	flowsMutex *sync.Mutex
+}
+
+func newTransparent(bind string, mode string) (*transparent, error) {
+	listener, err := listenTransparentTCP(bind, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transparent{
+		mode:       mode,
+		listener:   listener,
+		port:       listener.Addr().(*net.TCPAddr).Port,
+		flows:      map[string]*net.UDPConn{},
+		flowsMutex: &sync.Mutex{},
+	}
+
+	// Original destination of udp packets can be recovered only with TPROXY.
+	if mode == "tproxy" {
+		if t.udp, err = listenTransparentUDP(bind); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// isSelf checks, whether client connected directly to transparent listener, which would make a loop.
+func (t *transparent) isSelf(ip net.IP, port int) bool {
+	if port != t.port {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if subnet, ok := addr.(*net.IPNet); ok && subnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *transparent) Close() {
+	t.listener.Close()
+	if t.udp != nil {
+		t.udp.Close()
+	}
+
+	t.flowsMutex.Lock()
+	for _, remote := range t.flows {
+		remote.Close()
+	}
+	t.flowsMutex.Unlock()
+}
+
+func (t *transparent) serveTCP(s *Server) {
+	for s.work {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if s.work {
+				log.Errorln("(transparent proxy)", err)
+			}
+			continue
+		}
+
+		go handleTransparent(s, t, conn)
+	}
+}
+
+// handleTransparent proxies redirected connection the same way, as socks CONNECT from anonymous user.
+func handleTransparent(s *Server, t *transparent, conn net.Conn) {
+	defer conn.Close()
+
+	client := conn.RemoteAddr().String()
+	if err := checkSubnetsRules(s, nil, conn); err != nil {
+		log.Errorln("client:", client, "security error:", err)
+		return
+	}
+	if err := checkSchedule(s, nil, "transparent"); err != nil {
+		log.Errorln("client:", client, "schedule error:", err)
+		return
+	}
+	sess := s.sessions.add("transparent", conn)
+	defer s.sessions.remove(sess)
+	sess.setProtocol("transparent")
+
+	dst, err := originalDestination(conn, t.mode)
+	if err != nil {
+		log.Errorln("client:", client, "transparent error:", err)
+		return
+	}
+	if t.isSelf(dst.IP, dst.Port) {
+		log.Errorln("client:", client, "transparent error: connection to proxy itself")
+		return
+	}
+
+	log.Infof("%s connecting to %s (transparent)", client, dst.String())
+	sess.setDestination(dst.String())
+
+	remote, err := connectIP(s, nil, dst.IP, uint16(dst.Port))
+	if err != nil {
+		log.Errorln("client:", client, "error:", err)
+		return
+	}
+
+	if err = proxyConnection(s, nil, client, sess.conn, remote, "", uint16(dst.Port)); err != nil {
+		log.Errorln("client:", client, "error:", err)
+	}
+}
+
+func (t *transparent) serveUDP(s *Server) {
+	buffer := make([]byte, 0xFFFF)
+	for s.work {
+		n, client, dst, err := readTransparentUDP(t.udp, buffer)
+		if err != nil {
+			if s.work {
+				log.Errorln("(transparent proxy)", err)
+			}
+			continue
+		}
+
+		if err = t.sendUDP(s, client, dst, buffer[:n]); err != nil {
+			log.Errorln("client:", client.String(), "transparent udp error:", err)
+		}
+	}
+}
+
+func (t *transparent) sendUDP(s *Server, client *net.UDPAddr, dst *net.UDPAddr, data []byte) error {
+	key := client.String() + "-" + dst.String()
+
+	t.flowsMutex.Lock()
+	remote, ok := t.flows[key]
+	t.flowsMutex.Unlock()
+
+	if !ok {
+		if err := checkClientSubnetsRules(s, nil, client.IP); err != nil {
+			return err
+		}
+		if t.isSelf(dst.IP, dst.Port) {
+			return fmt.Errorf("packet to proxy itself")
+		}
+		if err := checkRemoteSubnetsRules(s, nil, dst.IP); err != nil {
+			return err
+		}
+
+		var err error
+		if remote, err = net.DialUDP("udp", nil, dst); err != nil {
+			return err
+		}
+
+		log.Infof("%s sending udp to %s (transparent)", client.String(), dst.String())
+
+		t.flowsMutex.Lock()
+		t.flows[key] = remote
+		t.flowsMutex.Unlock()
+
+		go t.flowReplies(s, key, client, dst, remote)
+	}
+
+	_, err := remote.Write(data)
+	return err
+}
+
+// flowReplies sends packets from remote back to client, until flow is idle for server timeout.
+// Every reply uses new socket, bound to original destination: kept open, it would get client packets instead of us.
+func (t *transparent) flowReplies(s *Server, key string, client *net.UDPAddr, dst *net.UDPAddr, remote *net.UDPConn) {
+	defer func() {
+		t.flowsMutex.Lock()
+		delete(t.flows, key)
+		t.flowsMutex.Unlock()
+
+		remote.Close()
+	}()
+
+	timeoutDuration := time.Duration(s.config.Server.Timeout) * time.Second
+	buffer := make([]byte, 0xFFFF)
+	for {
+		remote.SetReadDeadline(time.Now().Add(timeoutDuration))
+		n, err := remote.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		reply, err := listenTransparentReply(dst)
+		if err != nil {
+			log.Errorln("client:", client.String(), "transparent udp error:", err)
+			return
+		}
+		_, err = reply.WriteToUDP(buffer[:n], client)
+		reply.Close()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+//go:build linux
+// +build linux
+
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux netfilter headers.
+const soOriginalDst = 80
+
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func isIPv4Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() != nil
+}
+
+// transparentControl sets socket options, needed to accept connections and packets for foreign addresses.
+func transparentControl(ipv4 bool, options ...int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			for _, option := range options {
+				switch option {
+				case unix.IP_TRANSPARENT:
+					if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); sockErr == nil && !ipv4 {
+						sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+					}
+				case unix.IP_RECVORIGDSTADDR:
+					if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); sockErr == nil && !ipv4 {
+						sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+					}
+				case unix.SO_REUSEADDR:
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				}
+				if sockErr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+func listenTransparentTCP(addr string, mode string) (net.Listener, error) {
+	if mode != "tproxy" {
+		return net.Listen("tcp", addr)
+	}
+
+	config := &net.ListenConfig{Control: transparentControl(isIPv4Addr(addr), unix.IP_TRANSPARENT)}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	config := &net.ListenConfig{Control: transparentControl(isIPv4Addr(addr), unix.SO_REUSEADDR, unix.IP_TRANSPARENT, unix.IP_RECVORIGDSTADDR)}
+	conn, err := config.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// originalDestination returns address, where client was connecting before it was redirected to us.
+func originalDestination(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if mode == "tproxy" {
+		return local, nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent connection isn't tcp")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// Kernel returns sockaddr_in, it fits in ipv6_mreq structure.
+			var mreq *unix.IPv6Mreq
+			if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); sockErr == nil {
+				m := mreq.Multiaddr
+				addr = &net.TCPAddr{IP: net.IPv4(m[4], m[5], m[6], m[7]), Port: int(m[2])<<8 | int(m[3])}
+			}
+		} else {
+			// And sockaddr_in6 fits in ip6_mtuinfo.
+			var info *unix.IPv6MTUInfo
+			if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst); sockErr == nil {
+				ip := make(net.IP, net.IPv6len)
+				copy(ip, info.Addr.Addr[:])
+				addr = &net.TCPAddr{IP: ip, Port: ntohs(info.Addr.Port)}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("can't get original destination: %s", sockErr)
+	}
+
+	return addr, nil
+}
+
+// readTransparentUDP reads packet with its original destination from TPROXY socket.
+func readTransparentUDP(conn *net.UDPConn, buffer []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 128)
+	n, oobn, _, client, err := conn.ReadMsgUDP(buffer, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	for _, message := range messages {
+		data := message.Data
+		if message.Header.Level == unix.SOL_IP && message.Header.Type == unix.IP_ORIGDSTADDR && len(data) >= 8 {
+			return n, client, &net.UDPAddr{IP: net.IPv4(data[4], data[5], data[6], data[7]), Port: int(data[2])<<8 | int(data[3])}, nil
+		}
+		if message.Header.Level == unix.SOL_IPV6 && message.Header.Type == unix.IPV6_ORIGDSTADDR && len(data) >= 24 {
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, data[8:24])
+			return n, client, &net.UDPAddr{IP: ip, Port: int(data[2])<<8 | int(data[3])}, nil
+		}
+	}
+
+	return 0, nil, nil, fmt.Errorf("udp packet without original destination")
+}
+
+// listenTransparentReply creates socket with foreign address, so replies come to client from original destination.
+func listenTransparentReply(from *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if from.IP.To4() != nil {
+		network = "udp4"
+	}
+
+	config := &net.ListenConfig{Control: transparentControl(network == "udp4", unix.SO_REUSEADDR, unix.IP_TRANSPARENT)}
+	conn, err := config.ListenPacket(context.Background(), network, from.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
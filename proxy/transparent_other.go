@@ -0,0 +1,53 @@
+//go:build !linux
+// +build !linux
+
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+var errTransparentUnsupported = fmt.Errorf("transparent proxy is supported only on linux")
+
+func listenTransparentTCP(addr string, mode string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func readTransparentUDP(conn *net.UDPConn, buffer []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentUnsupported
+}
+
+func listenTransparentReply(from *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
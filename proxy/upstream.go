@@ -0,0 +1,185 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"virgild/models"
+)
+
+// dialUpstream connects to host:port through chain of upstream proxies, every next hop is
+// reached via CONNECT to the previous one.
+func dialUpstream(s *Server, chain []*models.UpstreamConfig, host string, port uint16) (net.Conn, error) {
+	timeoutDuration := time.Duration(s.config.Server.Timeout) * time.Second
+
+	conn, err := net.DialTimeout("tcp", chain[0].Address, timeoutDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeoutDuration))
+	for i, upstream := range chain {
+		nextHost, nextPort := host, port
+		if i+1 < len(chain) {
+			h, p, err := net.SplitHostPort(chain[i+1].Address)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			nextHost, nextPort = h, uint16(n)
+		}
+
+		if upstream.Type == "http" {
+			conn, err = upstreamHTTPConnect(conn, upstream, nextHost, nextPort)
+		} else {
+			err = upstreamSocks5Connect(conn, upstream, nextHost, nextPort)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream %s: %s", upstream.Address, err)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func upstreamSocks5Connect(conn net.Conn, upstream *models.UpstreamConfig, host string, port uint16) error {
+	method := byte(0x00)
+	if len(upstream.Username) > 0 {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	answer := make([]byte, 2)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if answer[0] != 0x05 || answer[1] != method {
+		return fmt.Errorf("socks5 auth method not accepted")
+	}
+
+	if method == 0x02 {
+		if len(upstream.Username) > 0xFF || len(upstream.Password) > 0xFF {
+			return fmt.Errorf("socks5 username or password is too long")
+		}
+		request := []byte{0x01, byte(len(upstream.Username))}
+		request = append(request, upstream.Username...)
+		request = append(request, byte(len(upstream.Password)))
+		request = append(request, upstream.Password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return err
+		}
+		if answer[1] != 0x00 {
+			return fmt.Errorf("socks5 authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, 0x01), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 0xFF {
+			return fmt.Errorf("socks5 hostname is too long")
+		}
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5 connect failed with code %d", reply[1])
+	}
+
+	var addrLen int
+	switch reply[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("socks5 reply has unknown address type")
+	}
+
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func upstreamHTTPConnect(conn net.Conn, upstream *models.UpstreamConfig, host string, port uint16) (net.Conn, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if len(upstream.Username) > 0 {
+		credentials := base64.StdEncoding.EncodeToString([]byte(upstream.Username + ":" + upstream.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("http connect failed with status %s", response.Status)
+	}
+
+	// Upstream may send tunneled data together with answer.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
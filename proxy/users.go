@@ -0,0 +1,106 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// checkPassword authenticates user by auth methods and loads his record.
+func checkPassword(s *Server, authMethods []models.AuthMethod, username, password string) (*models.User, bool) {
+	for _, method := range authMethods {
+		ok, err := method.Check(username, password)
+		if err != nil {
+			log.Errorln("(auth)", err)
+		}
+		if ok {
+			user, err := loadUser(s, username)
+			if err != nil {
+				log.Errorln("(auth)", err)
+				return nil, false
+			}
+
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+// loadUser loads attributes of user, authenticated by any method, from auth methods, that store them.
+// Expired users are rejected here, so every login is checked.
+func loadUser(s *Server, name string) (*models.User, error) {
+	user := &models.User{Name: name}
+	for _, method := range s.authMethods {
+		storage, ok := method.(models.AttributesMethod)
+		if !ok {
+			continue
+		}
+
+		attributes, err := storage.Attributes(name)
+		if err != nil {
+			return nil, err
+		}
+		if attributes != nil {
+			if user, err = models.NewUser(name, attributes); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if user.Expired() {
+		return nil, fmt.Errorf("user %s expired at %s", name, user.Expires.Format("2006-01-02 15:04:05"))
+	}
+	if s.userLocked(name) {
+		return nil, fmt.Errorf("user %s is locked", name)
+	}
+
+	return user, nil
+}
+
+// lockUser forbids new logins of user until unlock or restart, his sessions are closed.
+func (s *Server) lockUser(name string) int {
+	s.lockedUsersMutex.Lock()
+	s.lockedUsers[name] = true
+	s.lockedUsersMutex.Unlock()
+
+	return s.sessions.closeUser(name)
+}
+
+func (s *Server) unlockUser(name string) {
+	s.lockedUsersMutex.Lock()
+	delete(s.lockedUsers, name)
+	s.lockedUsersMutex.Unlock()
+}
+
+func (s *Server) userLocked(name string) bool {
+	s.lockedUsersMutex.Lock()
+	defer s.lockedUsersMutex.Unlock()
+
+	return s.lockedUsers[name]
+}
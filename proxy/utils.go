@@ -27,8 +27,19 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
 )
 
+// bufferedConn reads from reader first, because it may contain data, that client already sent.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
 func readUntilNullByte(reader *bufio.Reader, limit int) ([]byte, error) {
 	var tmp byte
 	var err error
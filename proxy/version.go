@@ -26,6 +26,7 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"strconv"
 
 	"virgild/models"
 )
@@ -48,3 +49,38 @@ func getProxyClientVersion(s *Server, conn net.Conn, reader *bufio.Reader) (mode
 		return nil, fmt.Errorf("client send unknown socks version")
 	}
 }
+
+func clientProtocol(proxy models.ProxyClient) string {
+	switch proxy.(type) {
+	case *socks4Client:
+		return "socks4"
+	case *socks5Client:
+		return "socks5"
+	case *httpClient:
+		return "http"
+	}
+
+	return ""
+}
+
+// clientDestination returns requested host and port. Http client can request other hosts later, then it's the first one.
+func clientDestination(proxy models.ProxyClient) string {
+	switch c := proxy.(type) {
+	case *socks4Client:
+		if c.useHostname {
+			return net.JoinHostPort(c.hostname, strconv.Itoa(int(c.port)))
+		}
+		return net.JoinHostPort(c.ip.String(), strconv.Itoa(int(c.port)))
+	case *socks5Client:
+		if c.request.useHostname {
+			return net.JoinHostPort(c.request.hostname, strconv.Itoa(int(c.request.port)))
+		}
+		return net.JoinHostPort(c.request.ip.String(), strconv.Itoa(int(c.request.port)))
+	case *httpClient:
+		if len(c.hostname) > 0 {
+			return net.JoinHostPort(c.hostname, strconv.Itoa(c.port))
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,358 @@
+/*MIT License
+
+Copyright (c) 2018 Станислав (swork91@mail.ru)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE. */
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"virgild/models"
+)
+
+// Magic value from RFC 6455, that is concatenated with client key to get accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// websocket is listener, where clients speak usual proxy protocols inside of WebSocket stream.
+type websocket struct {
+	config    *models.WebSocketConfig
+	listener  net.Listener
+	tlsConfig *tls.Config
+}
+
+func newWebSocket(config *models.WebSocketConfig) (*websocket, error) {
+	w := &websocket{config: config}
+
+	if len(config.PublicKey) > 0 && len(config.PrivateKey) > 0 {
+		keypair, err := tls.LoadX509KeyPair(config.PublicKey, config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		w.tlsConfig = &tls.Config{Certificates: []tls.Certificate{keypair}, MinVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}}
+	}
+
+	var err error
+	if w.listener, err = net.Listen("tcp", config.Bind); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *websocket) serve(s *Server) {
+	for s.work {
+		conn, err := w.listener.Accept()
+		if err != nil {
+			if s.work {
+				log.Errorln("(websocket)", err)
+			}
+			continue
+		}
+
+		go handleWebSocket(s, w, conn)
+	}
+}
+
+func (w *websocket) Close() error {
+	return w.listener.Close()
+}
+
+func handleWebSocket(s *Server, w *websocket, conn net.Conn) {
+	conn, err := acceptProxyProtocol(s, conn)
+	if err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "proxy protocol error:", err)
+		conn.Close()
+		return
+	}
+	if w.tlsConfig != nil {
+		conn = tls.Server(conn, w.tlsConfig)
+	}
+
+	ws, err := w.upgrade(s, conn)
+	if err != nil {
+		log.Errorln("client:", conn.RemoteAddr().String(), "websocket error:", err)
+		conn.Close()
+		return
+	}
+
+	serveClient(s, ws, "websocket")
+}
+
+// upgrade reads http request from client and switches connection to WebSocket protocol.
+func (w *websocket) upgrade(s *Server, conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(s.config.Server.Timeout) * time.Second))
+
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if status, err := w.check(request); err != nil {
+		answer := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+		if status == http.StatusUpgradeRequired {
+			answer += "Sec-WebSocket-Version: 13\r\n"
+		}
+		conn.Write([]byte(answer + "Content-Length: 0\r\nConnection: close\r\n\r\n"))
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(request.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+	answer := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(answer)); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &wsConn{Conn: conn, reader: reader, writeMutex: &sync.Mutex{}}, nil
+}
+
+// check validates WebSocket handshake request and returns http status for rejected one.
+func (w *websocket) check(request *http.Request) (int, error) {
+	if request.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, fmt.Errorf("wrong method %s", request.Method)
+	}
+	if len(w.config.Path) > 0 && request.URL.Path != w.config.Path {
+		return http.StatusNotFound, fmt.Errorf("wrong path %s", request.URL.Path)
+	}
+
+	if len(w.config.Token) > 0 {
+		token := request.URL.Query().Get("token")
+		if authorization := request.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+			token = authorization[7:]
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(w.config.Token)) != 1 {
+			return http.StatusUnauthorized, fmt.Errorf("wrong token")
+		}
+	}
+
+	if !headerContains(request.Header, "Upgrade", "websocket") || !headerContains(request.Header, "Connection", "upgrade") {
+		return http.StatusBadRequest, fmt.Errorf("not a websocket request")
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusUpgradeRequired, fmt.Errorf("unsupported websocket version %s", request.Header.Get("Sec-WebSocket-Version"))
+	}
+	if key, err := base64.StdEncoding.DecodeString(request.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		return http.StatusBadRequest, fmt.Errorf("wrong websocket key")
+	}
+
+	return http.StatusSwitchingProtocols, nil
+}
+
+// headerContains checks comma separated header values for token, ignoring case.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wsConn is net.Conn on top of WebSocket stream, message boundaries are ignored.
+// Client frames are always masked, server frames are never masked (RFC 6455).
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// Payload of current data frame, that is not read yet.
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+
+	writeMutex *sync.Mutex
+	closed     bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.reader.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= uint64(n)
+
+	return n, err
+}
+
+// nextFrame reads frame header, answering on control frames, until data frame comes.
+func (c *wsConn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return fmt.Errorf("websocket frame from client is not masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+
+	if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > 125 {
+			return fmt.Errorf("websocket control frame is too long")
+		}
+	default:
+		return fmt.Errorf("unknown websocket opcode %d", opcode)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= c.mask[i&3]
+	}
+
+	switch opcode {
+	case wsOpClose:
+		// Echo status code back and finish stream.
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		c.close(payload)
+		return io.EOF
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	}
+
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// close sends close frame once, so client knows that stream ended normally.
+func (c *wsConn) close(status []byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write(append([]byte{0x80 | wsOpClose, byte(len(status))}, status...))
+}
+
+func (c *wsConn) Close() error {
+	// 1000 is normal closure.
+	c.close([]byte{0x03, 0xE8})
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,169 @@
+#!/bin/sh
+# Integration test of transparent proxy (REDIRECT and TPROXY, tcp and udp) in linux network namespaces.
+# Needs root, iproute2, iptables, python3 and go. Usage: sudo scripts/transparent-netns.sh
+#
+# client (10.200.1.2) --- (10.200.1.1) proxy (10.200.2.1) --- (10.200.2.2) server
+#
+# Echo servers answer with address of peer, so test sees, that traffic came from proxy, not from client.
+
+set -eu
+
+cd "$(dirname "$0")/.."
+
+PREFIX=vdtp
+WORK=$(mktemp -d)
+FAILED=0
+
+# stop_ns kills all processes in namespace (ip netns exec may run them as children).
+stop_ns() {
+	ip netns pids "$PREFIX-$1" 2>/dev/null | xargs -r kill 2>/dev/null || true
+}
+
+cleanup() {
+	for ns in client proxy server; do
+		stop_ns "$ns"
+		ip netns del "$PREFIX-$ns" 2>/dev/null || true
+	done
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+trap "exit 1" INT TERM
+
+in_ns() {
+	ns=$1
+	shift
+	ip netns exec "$PREFIX-$ns" "$@"
+}
+
+setup_network() {
+	for ns in client proxy server; do
+		ip netns add "$PREFIX-$ns"
+		in_ns "$ns" ip link set lo up
+	done
+
+	ip link add "$PREFIX-c" netns "$PREFIX-client" type veth peer name "$PREFIX-pc" netns "$PREFIX-proxy"
+	ip link add "$PREFIX-s" netns "$PREFIX-server" type veth peer name "$PREFIX-ps" netns "$PREFIX-proxy"
+
+	in_ns client ip addr add 10.200.1.2/24 dev "$PREFIX-c"
+	in_ns client ip link set "$PREFIX-c" up
+	in_ns client ip route add default via 10.200.1.1
+
+	in_ns proxy ip addr add 10.200.1.1/24 dev "$PREFIX-pc"
+	in_ns proxy ip addr add 10.200.2.1/24 dev "$PREFIX-ps"
+	in_ns proxy ip link set "$PREFIX-pc" up
+	in_ns proxy ip link set "$PREFIX-ps" up
+	in_ns proxy sysctl -qw net.ipv4.ip_forward=1
+
+	in_ns server ip addr add 10.200.2.2/24 dev "$PREFIX-s"
+	in_ns server ip link set "$PREFIX-s" up
+	in_ns server ip route add default via 10.200.2.1
+}
+
+start_servers() {
+	cat > "$WORK/echo.py" <<'EOF'
+import socket, threading
+
+def tcp():
+    s = socket.socket()
+    s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    s.bind(("10.200.2.2", 9000))
+    s.listen()
+    while True:
+        c, peer = s.accept()
+        c.sendall(c.recv(1024) + b" from " + peer[0].encode())
+        c.close()
+
+def udp():
+    s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    s.bind(("10.200.2.2", 9001))
+    while True:
+        data, peer = s.recvfrom(1024)
+        s.sendto(data + b" from " + peer[0].encode(), peer)
+
+threading.Thread(target=tcp, daemon=True).start()
+udp()
+EOF
+	in_ns server python3 "$WORK/echo.py" &
+}
+
+# client_tcp and client_udp print reply of echo server (udp also prints source of reply).
+client_tcp() {
+	in_ns client python3 -c '
+import socket
+c = socket.create_connection(("10.200.2.2", 9000), timeout=5)
+c.sendall(b"ping")
+print(c.recv(1024).decode())'
+}
+
+client_udp() {
+	in_ns client python3 -c '
+import socket
+c = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+c.settimeout(5)
+c.sendto(b"ping", ("10.200.2.2", 9001))
+data, peer = c.recvfrom(1024)
+print(data.decode(), "reply from", "%s:%d" % peer)'
+}
+
+start_virgild() {
+	cat > "$WORK/virgild.conf" <<EOF
+[server]
+bind = 127.0.0.1:1080
+timeout = 10
+allowAnonymous = true
+logLevel = debug
+logFile = $WORK/virgild.log
+transparentBind = 0.0.0.0:1081
+transparentMode = $1
+EOF
+	in_ns proxy "$WORK/virgild" -c "$WORK/virgild.conf" > "$WORK/virgild.out" 2>&1 &
+	sleep 1
+}
+
+stop_virgild() {
+	stop_ns proxy
+	sleep 0.5
+}
+
+check() {
+	name=$1
+	expected=$2
+	actual=$3
+	if [ "$actual" = "$expected" ]; then
+		echo "ok   $name"
+	else
+		echo "FAIL $name: expected \"$expected\", got \"$actual\""
+		FAILED=1
+	fi
+}
+
+go build -o "$WORK/virgild" .
+setup_network
+start_servers
+sleep 0.5
+
+# Without proxy server sees client itself.
+check "direct tcp" "ping from 10.200.1.2" "$(client_tcp 2>&1 || true)"
+
+# REDIRECT: tcp only.
+in_ns proxy iptables -t nat -A PREROUTING -i "$PREFIX-pc" -p tcp -j REDIRECT --to-ports 1081
+start_virgild redirect
+check "redirect tcp" "ping from 10.200.2.1" "$(client_tcp 2>&1 || true)"
+stop_virgild
+in_ns proxy iptables -t nat -F PREROUTING
+
+# TPROXY: tcp and udp, replies to udp client must come from original destination.
+in_ns proxy iptables -t mangle -A PREROUTING -i "$PREFIX-pc" -p tcp -j TPROXY --on-port 1081 --tproxy-mark 1
+in_ns proxy iptables -t mangle -A PREROUTING -i "$PREFIX-pc" -p udp -j TPROXY --on-port 1081 --tproxy-mark 1
+in_ns proxy ip rule add fwmark 1 lookup 100
+in_ns proxy ip route add local 0.0.0.0/0 dev lo table 100
+start_virgild tproxy
+check "tproxy tcp" "ping from 10.200.2.1" "$(client_tcp 2>&1 || true)"
+check "tproxy udp" "ping from 10.200.2.1 reply from 10.200.2.2:9001" "$(client_udp 2>&1 || true)"
+stop_virgild
+
+if [ "$FAILED" -ne 0 ]; then
+	echo "virgild log:"
+	cat "$WORK/virgild.log" "$WORK/virgild.out" 2>/dev/null || true
+	exit 1
+fi